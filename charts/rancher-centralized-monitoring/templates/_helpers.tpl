@@ -70,4 +70,15 @@ Create secret name for Rancher API credentials
 {{- else }}
 {{- include "rancher-centralized-monitoring.fullname" . }}-credentials
 {{- end }}
-{{- end }}
\ No newline at end of file
+{{- end }}
+
+{{/*
+Name of the ConfigMap holding the config file
+*/}}
+{{- define "rancher-centralized-monitoring.configMapName" -}}
+{{- if .Values.config.existingConfigMap }}
+{{- .Values.config.existingConfigMap }}
+{{- else }}
+{{- include "rancher-centralized-monitoring.fullname" . }}-config
+{{- end }}
+{{- end }}
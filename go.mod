@@ -2,9 +2,31 @@ module github.com/supporttools/rancher-centralized-monitoring
 
 go 1.21.4
 
-require github.com/sirupsen/logrus v1.9.3
+require (
+	github.com/prometheus/client_golang v1.17.0
+	github.com/prometheus/common v0.44.0
+	github.com/prometheus/prometheus v0.48.1
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/stretchr/testify v1.8.4 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dennwc/varint v1.0.0 // indirect
+	github.com/go-kit/log v0.2.1 // indirect
+	github.com/go-logfmt/logfmt v0.6.0 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/grafana/regexp v0.0.0-20221122212121-6b5c0a4cb7fd // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
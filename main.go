@@ -1,56 +1,114 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/auth"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/credentials"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/fanout"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/health"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/metrics"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/proxy"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/reload"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/server"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
 )
 
 var logger = logging.SetupLogging()
 
+// Exit codes after the listeners have started
+const (
+	exitDrained        = 0 // every in-flight request finished
+	exitListenerFailed = 1 // a listener stopped serving unexpectedly
+	exitCutOff         = 2 // requests were still in flight when the shutdown timeout expired
+)
+
+// configFile is the optional YAML or JSON config file; environment variables override it
+var configFile = flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+
 func main() {
+	flag.Parse()
+
+	// Background loops run until shutdown starts
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
 	logger.Println("Starting Rancher Centralized Monitoring Agent")
+
+	// Load and validate the configuration in one place
+	loaded, err := config.Load(*configFile)
+	if err != nil {
+		if validationErr, ok := err.(*config.ValidationError); ok {
+			for _, problem := range validationErr.Problems {
+				logger.Printf("Configuration error: %s", problem)
+			}
+			logger.Fatalf("Invalid configuration: %d problem(s) found", len(validationErr.Problems))
+		}
+		logger.Fatal(err)
+	}
+	if *configFile != "" {
+		logger.Printf("Loaded configuration from %s", *configFile)
+	}
 	if config.CFG.Debug {
 		logger.Println("Debug mode enabled")
 	}
 
-	config.LoadConfigFromEnv()
+	info := health.Info()
+	metrics.SetBuildInfo(info.Version, info.GitCommit, info.BuildTime)
 
-	// Check if environment variables are set
+	// Load the credentials used for every outgoing request
+	source, err := credentials.Load(config.CFG)
+	if err != nil {
+		logger.Fatal("Invalid Rancher credentials configuration: ", err)
+	}
+	credentials.SetCurrent(source)
 	if config.CFG.RancherApiEndpoint == "" {
-		logger.Fatal("RANCHER_API_ENDPOINT environment variable not set")
+		config.CFG.RancherApiEndpoint = source.Endpoint
 	}
-	if config.CFG.RancherApiAccessKey == "" {
-		logger.Fatal("RANCHER_API_ACCESS_KEY environment variable not set")
+	if source.Direct {
+		config.CFG.DirectClusterAPI = true
 	}
-	if config.CFG.RancherApiSecretKey == "" {
-		logger.Fatal("RANCHER_API_SECRET_KEY environment variable not set")
+	config.Set(config.CFG)
+	logger.Printf("Using %s authentication", source.Type)
+
+	cluster.Default.LoadFromConfig(config.CFG)
+
+	if err := transport.LoadTLSConfig(config.CFG); err != nil {
+		logger.Fatal("Invalid Rancher TLS configuration: ", err)
 	}
-	if config.CFG.ClusterId == "" {
-		logger.Fatal("CLUSTER_ID environment variable not set")
+
+	// Pick up rotated credential and certificate files without a restart
+	credentials.OnReload(func(source *credentials.Source) {
+		if source.Endpoint != "" && source.Endpoint != config.CFG.RancherApiEndpoint {
+			logger.Printf("Warning: Rotated credentials point at %s, a restart is required to change the endpoint", source.Endpoint)
+		}
+		if err := transport.Reload(config.CFG); err != nil {
+			logger.Printf("Error reloading Rancher TLS configuration: %v", err)
+		}
+	})
+	credentialWatcher := credentials.NewWatcher(config.CFG)
+	if config.CFG.CredentialsReloadInterval > 0 {
+		logger.Printf("Watching credential files every %s", config.CFG.CredentialsReloadInterval)
+		go credentialWatcher.Run(ctx)
 	}
 
 	// Verify access to Rancher API
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.CFG.RancherInsecureSkipVerify,
-			},
-		},
-	}
-	req, err := http.NewRequest("GET", config.CFG.RancherApiEndpoint, http.NoBody)
+	client := transport.NewClient(transport.RancherUpstream, 10*time.Second)
+	req, err := http.NewRequest("GET", proxy.RancherCheckURL(), http.NoBody)
 	if err != nil {
 		logger.Fatal("Error creating request: ", err)
 	}
-	req.SetBasicAuth(config.CFG.RancherApiAccessKey, config.CFG.RancherApiSecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -64,137 +122,185 @@ func main() {
 
 	logger.Println("Successfully connected to Rancher API")
 
-	// Test connectivity to Loki service via proxy
-	lokiURL := proxy.BuildLokiURL()
-	logger.Printf("Testing Loki connectivity at: %s", lokiURL)
+	// Discover clusters from the Rancher management API if enabled
+	var discoverer *cluster.Discoverer
+	if config.CFG.DiscoveryEnabled {
+		discoverer, err = cluster.NewDiscoverer(config.CFG, cluster.Default)
+		if err != nil {
+			logger.Fatal("Invalid cluster discovery configuration: ", err)
+		}
+		if err := discoverer.Sync(ctx); err != nil {
+			logger.Printf("Warning: Initial cluster discovery failed: %v", err)
+		}
+		logger.Printf("Starting cluster discovery every %s", config.CFG.DiscoveryInterval)
+		go discoverer.Run(ctx)
+	}
+
+	for _, c := range cluster.Default.List() {
+		logger.Printf("Relaying cluster %s (%s)", c.ID, c.DisplayName())
+	}
+
+	// Check Rancher and every upstream in the background for /health and /ready
+	health.StartProber(ctx)
 
-	if err := proxy.TestServiceConnectivity(lokiURL, "loki"); err != nil {
-		logger.Printf("Warning: Failed to connect to Loki service: %v", err)
+	// Authenticate clients of the proxy and query endpoints
+	inbound, err := auth.New(config.CFG)
+	if err != nil {
+		logger.Fatal("Invalid inbound authentication configuration: ", err)
+	}
+	if len(inbound) == 0 {
+		logger.Println("Warning: Inbound authentication is disabled, anyone who can reach the relay can query every cluster")
 	}
 
-	// Test connectivity to Prometheus service via proxy if configured
-	if config.CFG.PrometheusNamespace != "" {
-		prometheusURL := proxy.BuildPrometheusURL()
-		logger.Printf("Testing Prometheus connectivity at: %s", prometheusURL)
+	// Start the metrics and proxy servers for the current configuration
+	servers := server.NewManager()
+	if err := servers.Apply(listeners(config.Current(), inbound)); err != nil {
+		logger.Fatalf("Failed to start servers: %v", err)
+	}
 
-		if err := proxy.TestServiceConnectivity(prometheusURL, "prometheus"); err != nil {
-			logger.Printf("Warning: Failed to connect to Prometheus service: %v", err)
+	logger.Println("All proxy servers started successfully")
+
+	// Apply configuration changes on SIGHUP or when the config file changes
+	reloader := reload.NewReloader(*configFile, loaded)
+	reloader.OnReload(func(cfg config.Config) error {
+		next, err := auth.New(cfg)
+		if err != nil {
+			// Keep authenticating with the previous settings rather than opening up
+			return fmt.Errorf("inbound authentication, keeping the previous settings: %v", err)
 		}
+		inbound = next
+		return nil
+	})
+	reloader.OnReload(func(cfg config.Config) error {
+		if discoverer != nil {
+			discoverer.SetStatic(cfg.ClusterTargets())
+		} else {
+			added, removed := cluster.Default.LoadFromConfig(cfg)
+			for _, c := range added {
+				logger.Printf("Relaying cluster %s (%s)", c.ID, c.DisplayName())
+			}
+			for _, c := range removed {
+				logger.Printf("Stopped relaying cluster %s (%s)", c.ID, c.DisplayName())
+			}
+		}
+		return servers.Apply(listeners(cfg, inbound))
+	})
+	go reloader.Run(ctx, config.CFG.ConfigReloadInterval)
+
+	// Serve until asked to stop or a listener fails
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	code := exitDrained
+	select {
+	case sig := <-signals:
+		logger.Printf("Received %s, shutting down", sig)
+	case err := <-servers.Errors():
+		logger.Printf("Shutting down after a listener failed: %v", err)
+		code = exitListenerFailed
 	}
+	stopBackground()
+	os.Exit(shutdown(servers, signals, code))
+}
 
-	// Test connectivity to custom remote service if configured
-	if config.CFG.RemoteNamespace != "" && config.CFG.RemoteService != "" && config.CFG.RemotePort != "" {
-		remoteURL := proxy.BuildServiceProxyURL(config.CFG.RemoteNamespace, config.CFG.RemoteService, config.CFG.RemotePort)
-		logger.Printf("Testing remote service connectivity at: %s", remoteURL)
+// shutdown fails readiness, waits for the drain delay so that load balancers
+// stop sending new requests, then stops the listeners once in-flight requests
+// have finished. A second signal skips the drain delay. It returns the exit code.
+func shutdown(servers *server.Manager, signals <-chan os.Signal, code int) int {
+	cfg := config.Current()
+	health.SetShuttingDown()
+
+	if code == exitDrained && cfg.ShutdownDrainDelay > 0 {
+		logger.Printf("Failing readiness for %s before stopping the listeners", cfg.ShutdownDrainDelay)
+		select {
+		case <-time.After(cfg.ShutdownDrainDelay):
+		case sig := <-signals:
+			logger.Printf("Received %s again, skipping the drain delay", sig)
+		}
+	}
 
-		if err := proxy.TestServiceConnectivity(remoteURL, config.CFG.RemoteService); err != nil {
-			logger.Printf("Warning: Failed to connect to remote service: %v", err)
+	logger.Printf("Stopping the listeners, waiting up to %s for %d in-flight request(s)", cfg.ShutdownTimeout, servers.InFlight())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := servers.Shutdown(ctx); err != nil {
+		logger.Printf("Shutdown timed out: %v", err)
+		if code == exitDrained {
+			code = exitCutOff
 		}
+		return code
 	}
 
-	// Setup metrics/health HTTP server (default port 9000)
+	logger.Println("All in-flight requests finished, exiting")
+	return code
+}
+
+// listeners returns the metrics server and the proxy servers enabled in cfg.
+// Proxy and query endpoints require a client accepted by inbound.
+func listeners(cfg config.Config, inbound auth.Chain) []server.Listener {
+	// Metrics/health server (default port 9000)
 	metricsMux := http.NewServeMux()
 	metricsMux.HandleFunc("/health", health.HealthzHandler())
 	metricsMux.HandleFunc("/ready", health.ReadyzHandler())
+	metricsMux.HandleFunc("/ready/", health.ServiceReadyzHandler())
+	metricsMux.HandleFunc("/status", health.StatusHandler())
 	metricsMux.HandleFunc("/version", health.VersionHandler())
+	metricsMux.HandleFunc("/config", health.ConfigHandler())
 	metricsMux.HandleFunc("/metrics", metrics.MetricsHandler())
-
-	metricsAddress := fmt.Sprintf(":%s", config.CFG.MetricsPort)
-	logger.Printf("Starting metrics HTTP server on %s", metricsAddress)
-
-	metricsServer := &http.Server{
-		Addr:              metricsAddress,
-		Handler:           metricsMux,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       120 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-	}
-
-	// Start metrics server in background
-	go func() {
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("Metrics HTTP server failed to start: %v", err)
-		}
-	}()
-
-	// Setup Prometheus proxy server on port 9090
-	if config.CFG.PrometheusNamespace != "" {
-		prometheusMux := http.NewServeMux()
-		prometheusMux.HandleFunc("/", proxy.PrometheusHandler())
-
-		prometheusAddress := ":9090"
-		logger.Printf("Starting Prometheus proxy server on %s -> %s", prometheusAddress, proxy.BuildPrometheusURL())
-
-		prometheusServer := &http.Server{
-			Addr:              prometheusAddress,
-			Handler:           prometheusMux,
-			ReadTimeout:       30 * time.Second,
-			WriteTimeout:      30 * time.Second,
-			IdleTimeout:       120 * time.Second,
-			ReadHeaderTimeout: 10 * time.Second,
-		}
-
-		// Start Prometheus proxy server in background
-		go func() {
-			if err := prometheusServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				logger.Fatalf("Prometheus proxy server failed to start: %v", err)
-			}
-		}()
+	metricsMux.Handle("/sd/prometheus", inbound.Require(metrics.ServiceDiscoveryHandler()))
+	if cfg.PrometheusNamespace != "" {
+		metricsMux.Handle("/api/v1/query", inbound.Require(fanout.PrometheusQueryHandler("/api/v1/query")))
+		metricsMux.Handle("/api/v1/query_range", inbound.Require(fanout.PrometheusQueryHandler("/api/v1/query_range")))
 	}
-
-	// Setup Loki proxy server on port 3100
-	lokiMux := http.NewServeMux()
-	lokiMux.HandleFunc("/", proxy.LokiHandler())
-
-	lokiAddress := ":3100"
-	logger.Printf("Starting Loki proxy server on %s -> %s", lokiAddress, proxy.BuildLokiURL())
-
-	lokiServer := &http.Server{
-		Addr:              lokiAddress,
-		Handler:           lokiMux,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       120 * time.Second,
-		ReadHeaderTimeout: 10 * time.Second,
+	if cfg.LokiNamespace != "" {
+		metricsMux.Handle("/loki/api/v1/query_range", inbound.Require(fanout.LokiQueryRangeHandler()))
+		metricsMux.Handle("/loki/api/v1/labels", inbound.Require(fanout.LokiLabelsHandler()))
 	}
 
-	// Start Loki proxy server in background
-	go func() {
-		if err := lokiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("Loki proxy server failed to start: %v", err)
+	var servers []server.Listener
+	_, metricsAddr := cfg.Listen(cfg.MetricsPort)
+
+	// Proxy servers for every upstream, on their own port or under a path of the metrics port
+	mounted := false
+	for _, u := range cfg.Upstreams() {
+		handler := inbound.Require(proxy.UpstreamHandler(u))
+		if cfg.SinglePort {
+			logger.Printf("%s proxy on %s%s/ -> %s/%s:%s", u.Name, metricsAddr, u.RouterPath(), u.Namespace, u.Service, u.Port)
+			metricsMux.Handle(u.RouterPath()+"/", proxy.Mount(u.RouterPath(), handler))
+			mounted = true
 		}
-	}()
-
-	// Setup custom remote service proxy if configured
-	if config.CFG.RemoteNamespace != "" && config.CFG.RemoteService != "" && config.CFG.RemotePort != "" {
-		remoteMux := http.NewServeMux()
-		remoteMux.HandleFunc("/", proxy.RemoteServiceHandler())
-
-		remoteAddress := fmt.Sprintf(":%s", config.CFG.RemotePort)
-		logger.Printf("Starting remote service proxy on %s -> %s",
-			remoteAddress,
-			proxy.BuildServiceProxyURL(config.CFG.RemoteNamespace, config.CFG.RemoteService, config.CFG.RemotePort))
-
-		remoteServer := &http.Server{
-			Addr:              remoteAddress,
-			Handler:           remoteMux,
-			ReadTimeout:       30 * time.Second,
-			WriteTimeout:      30 * time.Second,
-			IdleTimeout:       120 * time.Second,
-			ReadHeaderTimeout: 10 * time.Second,
+		if u.PathPrefix != "" {
+			prefix := strings.TrimSuffix(u.PathPrefix, "/")
+			logger.Printf("%s proxy on %s%s/ -> %s/%s:%s", u.Name, metricsAddr, prefix, u.Namespace, u.Service, u.Port)
+			metricsMux.Handle(prefix+"/", proxy.Mount(prefix, handler))
+			mounted = true
+		}
+		if u.ListenPort != "" && !cfg.SinglePort {
+			listener := newListener(cfg, u.Name, u.ListenPort, handler, true)
+			logger.Printf("%s proxy on %s -> %s/%s:%s", u.Name, listener.Addr, u.Namespace, u.Service, u.Port)
+			servers = append(servers, listener)
 		}
-
-		// Start remote service proxy in background
-		go func() {
-			if err := remoteServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				logger.Fatalf("Remote service proxy server failed to start: %v", err)
-			}
-		}()
 	}
 
-	logger.Println("All proxy servers started successfully")
+	// Proxies mounted on the metrics port stream like those on their own port,
+	// so its timeouts would cut off tails, long queries and large uploads
+	metricsListener := newListener(cfg, "metrics", cfg.MetricsPort, metricsMux, mounted)
+	return append([]server.Listener{metricsListener}, servers...)
+}
 
-	// Keep the main goroutine alive
-	select {}
+// newListener returns the named listener for a port, host:port or unix:/path
+// setting of cfg, with the TLS settings shared by every listener
+func newListener(cfg config.Config, name, listen string, handler http.Handler, streaming bool) server.Listener {
+	network, address := cfg.Listen(listen)
+	return server.Listener{
+		Name:    name,
+		Network: network,
+		Addr:    address,
+		TLS: server.TLS{
+			CertFile:     cfg.ListenerTLSCertFile,
+			KeyFile:      cfg.ListenerTLSKeyFile,
+			MinVersion:   cfg.ListenerTLSMinVersion,
+			ClientCAFile: cfg.InboundAuthClientCAFile,
+		},
+		Handler:   handler,
+		Streaming: streaming,
+	}
 }
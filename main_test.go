@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/auth"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestMetricsListenerStreamsMountedProxies(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*config.Config)
+		want      bool
+	}{
+		{
+			name:      "upstreams on their own ports",
+			configure: func(c *config.Config) {},
+			want:      false,
+		},
+		{
+			name:      "single port",
+			configure: func(c *config.Config) { c.SinglePort = true },
+			want:      true,
+		},
+		{
+			name: "path prefix",
+			configure: func(c *config.Config) {
+				c.CustomUpstreams = []config.Upstream{{Name: "billing", Namespace: "billing", Service: "billing-api", Port: "8443", PathPrefix: "/billing"}}
+			},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.RancherApiEndpoint = "https://rancher.example.com"
+			tt.configure(&cfg)
+			config.Set(cfg)
+
+			servers := listeners(cfg, nil)
+			if servers[0].Name != "metrics" {
+				t.Fatalf("first listener is %s, want metrics", servers[0].Name)
+			}
+			if servers[0].Streaming != tt.want {
+				t.Errorf("metrics listener streaming = %v, want %v", servers[0].Streaming, tt.want)
+			}
+			for _, l := range servers[1:] {
+				if !l.Streaming {
+					t.Errorf("%s listener is not streaming", l.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceDiscoveryRequiresInboundAuth(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.RancherApiEndpoint = "https://rancher.example.com"
+	config.Set(cfg)
+	inbound, err := auth.New(config.Config{InboundAuthTokens: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsHandler := listeners(cfg, inbound)[0].Handler
+
+	for _, tt := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/sd/prometheus", "", http.StatusUnauthorized},
+		{"/sd/prometheus", "secret", http.StatusOK},
+		{"/health", "", http.StatusServiceUnavailable},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		metricsHandler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s with token %q = %d, want %d", tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+)
+
+var logger = logging.SetupLogging()
+
+// realm is announced in WWW-Authenticate challenges
+const realm = "rancher-monitoring-relay"
+
+// Methods of inbound authentication, used as the prefix of client names
+const (
+	MethodBasic          = "basic"
+	MethodToken          = "token"
+	MethodCertificate    = "cert"
+	MethodServiceAccount = "sa"
+)
+
+// Identity is an authenticated client of the relay
+type Identity struct {
+	Name   string
+	Method string
+}
+
+// String returns the client name rules refer to, the name prefixed with the
+// method, e.g. basic:grafana. Names alone are not unique: the htpasswd user
+// grafana and a token named grafana are different clients.
+func (id Identity) String() string {
+	return id.Method + ":" + id.Name
+}
+
+// Authenticator verifies one kind of inbound credentials
+type Authenticator interface {
+	// Authenticate returns the client's identity, or false if the request
+	// carries no valid credentials of this kind
+	Authenticate(r *http.Request) (Identity, bool)
+	// Challenge returns the WWW-Authenticate value sent with a 401, or ""
+	Challenge() string
+}
+
+// Chain accepts a request if any of its authenticators does. An empty chain
+// accepts every request.
+type Chain []Authenticator
+
+// New returns the authenticators enabled in cfg. Files are read now, so a
+// missing or invalid file is reported before any request is served.
+func New(cfg config.Config) (Chain, error) {
+	var chain Chain
+
+	if len(cfg.InboundAuthTokens) > 0 || cfg.InboundAuthTokensFile != "" {
+		tokens, err := newStaticTokens(cfg.InboundAuthTokens, cfg.InboundAuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokens)
+	}
+	if cfg.InboundAuthHtpasswdFile != "" {
+		htpasswd, err := newHtpasswd(cfg.InboundAuthHtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, htpasswd)
+	}
+	if cfg.InboundAuthClientCAFile != "" {
+		chain = append(chain, clientCertificate{})
+	}
+	if cfg.InboundAuthTokenReview {
+		review, err := newTokenReview(cfg.InboundAuthTokenReviewAudiences)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, review)
+	}
+
+	return chain, nil
+}
+
+// identityContextKey is the request context key holding the client identity
+type identityContextKey struct{}
+
+// IdentityFrom returns the identity a request was authenticated as
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(Identity)
+	return id, ok
+}
+
+// Require returns a handler that serves next only to authenticated requests
+// and answers every other request with 401 Unauthorized
+func (c Chain) Require(next http.Handler) http.Handler {
+	if len(c) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, authenticator := range c {
+			if id, ok := authenticator.Authenticate(r); ok {
+				ctx := context.WithValue(r.Context(), identityContextKey{}, id)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		logger.Printf("Rejected unauthenticated request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		for _, authenticator := range c {
+			if challenge := authenticator.Challenge(); challenge != "" {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or ""
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fake accepts every request as its identity when ok is set and records
+// that it was asked
+type fake struct {
+	id        Identity
+	ok        bool
+	challenge string
+	asked     *[]string
+}
+
+func (f fake) Authenticate(r *http.Request) (Identity, bool) {
+	*f.asked = append(*f.asked, f.id.Name)
+	return f.id, f.ok
+}
+
+func (f fake) Challenge() string {
+	return f.challenge
+}
+
+// serve runs r through chain and returns the response and the identity the
+// handler saw, if it was reached
+func serve(chain Chain, r *http.Request) (*httptest.ResponseRecorder, *Identity) {
+	var seen *Identity
+	w := httptest.NewRecorder()
+	chain.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := IdentityFrom(r.Context())
+		seen = &id
+	})).ServeHTTP(w, r)
+	return w, seen
+}
+
+func TestChainRequire(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     []bool
+		wantAsked  []string
+		wantID     string
+		wantStatus int
+	}{
+		{"first accepts", []bool{true, true, true}, []string{"a"}, "a", http.StatusOK},
+		{"falls through", []bool{false, true, true}, []string{"a", "b"}, "b", http.StatusOK},
+		{"last accepts", []bool{false, false, true}, []string{"a", "b", "c"}, "c", http.StatusOK},
+		{"none accepts", []bool{false, false, false}, []string{"a", "b", "c"}, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked []string
+			var chain Chain
+			for i, ok := range tt.accept {
+				name := string(rune('a' + i))
+				challenge := ""
+				if i != 1 {
+					challenge = "Scheme-" + name
+				}
+				chain = append(chain, fake{id: Identity{Name: name, Method: MethodToken}, ok: ok, challenge: challenge, asked: &asked})
+			}
+
+			w, seen := serve(chain, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(asked, tt.wantAsked) {
+				t.Errorf("asked %v, want %v", asked, tt.wantAsked)
+			}
+			if tt.wantID == "" {
+				if seen != nil {
+					t.Error("handler reached without authentication")
+				}
+				// Every challenge is offered; empty ones are left out
+				want := []string{"Scheme-a", "Scheme-c"}
+				if got := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(got, want) {
+					t.Errorf("challenges = %q, want %q", got, want)
+				}
+				return
+			}
+			if seen == nil || seen.Name != tt.wantID {
+				t.Errorf("handler saw %+v, want %s", seen, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestEmptyChainAcceptsEveryRequest(t *testing.T) {
+	w, seen := serve(nil, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || seen == nil {
+		t.Errorf("status = %d, handler reached = %v", w.Code, seen != nil)
+	}
+}
+
+func TestIdentitiesOfDifferentMethodsDoNotCollide(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := New(config.Config{
+		InboundAuthTokensFile:   writeFile(t, "tokens", "grafana-token grafana\n"),
+		InboundAuthHtpasswdFile: writeFile(t, "htpasswd", "grafana:"+string(hash)+"\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer grafana-token")
+	_, token := serve(chain, r)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("grafana", "s3cret")
+	_, basic := serve(chain, r)
+
+	if token == nil || basic == nil {
+		t.Fatalf("not authenticated: token %v, basic %v", token, basic)
+	}
+	if token.String() != "token:grafana" || basic.String() != "basic:grafana" {
+		t.Errorf("identities = %s and %s, want token:grafana and basic:grafana", token, basic)
+	}
+}
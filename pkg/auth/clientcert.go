@@ -0,0 +1,21 @@
+package auth
+
+import "net/http"
+
+// clientCertificate accepts requests whose TLS client certificate was verified
+// against INBOUND_AUTH_CLIENT_CA_FILE by the listener
+type clientCertificate struct{}
+
+// Authenticate accepts a verified client certificate and names the client
+// after its subject common name
+func (clientCertificate) Authenticate(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	return Identity{Name: r.TLS.VerifiedChains[0][0].Subject.CommonName, Method: MethodCertificate}, true
+}
+
+// Challenge is empty: client certificates are requested during the TLS handshake
+func (clientCertificate) Challenge() string {
+	return ""
+}
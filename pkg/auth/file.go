@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCheckInterval is how often an auth file is checked for changes
+const fileCheckInterval = 30 * time.Second
+
+// watchedFile holds the parsed contents of a file and re-reads it when its
+// modification time changes, checking at most once per fileCheckInterval
+type watchedFile[T any] struct {
+	path  string
+	parse func([]byte) (T, error)
+
+	mu      sync.Mutex
+	value   T
+	modTime time.Time
+	checked time.Time
+}
+
+// newWatchedFile reads and parses the file at path
+func newWatchedFile[T any](path string, parse func([]byte) (T, error)) (*watchedFile[T], error) {
+	f := &watchedFile[T]{path: path, parse: parse}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// get returns the parsed contents, re-reading the file first if it changed.
+// If the changed file cannot be read or parsed the previous contents are kept.
+func (f *watchedFile[T]) get() T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) >= fileCheckInterval {
+		f.checked = time.Now()
+		if info, err := os.Stat(f.path); err == nil && !info.ModTime().Equal(f.modTime) {
+			if err := f.reload(); err != nil {
+				logger.Printf("Error reloading %s, keeping the previous contents: %v", f.path, err)
+			} else {
+				logger.Printf("Reloaded %s", f.path)
+			}
+		}
+	}
+	return f.value
+}
+
+// reload reads and parses the file
+func (f *watchedFile[T]) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return err
+	}
+	f.value = value
+	f.modTime = info.ModTime()
+	f.checked = time.Now()
+	return nil
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxVerifiedCache bounds the number of remembered successful logins
+const maxVerifiedCache = 1024
+
+// htpasswd accepts HTTP Basic credentials from an Apache htpasswd file with
+// bcrypt, SHA-1 or Apache MD5 (apr1) password hashes
+type htpasswd struct {
+	file *watchedFile[map[string]string]
+
+	// verified remembers logins whose hash was checked, as bcrypt is
+	// deliberately slow and clients such as Grafana log in on every request
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// newHtpasswd returns an authenticator for the htpasswd file at path
+func newHtpasswd(path string) (*htpasswd, error) {
+	file, err := newWatchedFile(path, parseHtpasswd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading htpasswd file: %v", err)
+	}
+	return &htpasswd{file: file, verified: make(map[[sha256.Size]byte]bool)}, nil
+}
+
+// parseHtpasswd reads user:hash lines and rejects hash formats it cannot verify
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"),
+			strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$apr1$"):
+		default:
+			return nil, fmt.Errorf("line %d: unsupported password hash for user %s, use bcrypt (htpasswd -B), SHA-1 or MD5", line, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Authenticate accepts Basic credentials matching a user of the file
+func (h *htpasswd) Authenticate(r *http.Request) (Identity, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, false
+	}
+	hash, ok := h.file.get()[user]
+	if !ok {
+		return Identity{}, false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	h.mu.Lock()
+	verified := h.verified[key]
+	h.mu.Unlock()
+	if !verified {
+		if !checkPassword(hash, password) {
+			return Identity{}, false
+		}
+		h.mu.Lock()
+		if len(h.verified) >= maxVerifiedCache {
+			h.verified = make(map[[sha256.Size]byte]bool)
+		}
+		h.verified[key] = true
+		h.mu.Unlock()
+	}
+	return Identity{Name: user, Method: MethodBasic}, true
+}
+
+// Challenge asks for Basic credentials
+func (h *htpasswd) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", realm)
+}
+
+// checkPassword reports whether password matches an htpasswd hash
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// apr1 returns the Apache MD5-crypt hash of password with the given salt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeFile writes contents to a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, "htpasswd", strings.Join([]string{
+		"# relay clients",
+		"",
+		"bcrypt:" + string(bcryptHash),
+		"apr1:$apr1$r31hgTQQ$rPtEChC9VZIVTV0QSyZRR1",
+		"apr1-long:$apr1$abc$IIW/V525X46ri30NUi0KL0",
+		"sha:{SHA}/vNB+F2HQ559kaLUZbmHHvZrXpg=",
+	}, "\n"))
+	h, err := newHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"bcrypt", "s3cret", true},
+		{"bcrypt", "wrong", false},
+		{"apr1", "s3cret", true},
+		{"apr1", "wrong", false},
+		{"apr1-long", "a much longer password than sixteen bytes", true},
+		{"sha", "s3cret", true},
+		{"sha", "wrong", false},
+		{"unknown", "s3cret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.password, func(t *testing.T) {
+			// Twice, the second time from the cache of verified logins
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth(tt.user, tt.password)
+				id, ok := h.Authenticate(r)
+				if ok != tt.ok {
+					t.Fatalf("Authenticate = %v, want %v", ok, tt.ok)
+				}
+				if ok && id != (Identity{Name: tt.user, Method: MethodBasic}) {
+					t.Errorf("identity = %+v", id)
+				}
+			}
+		})
+	}
+
+	if _, ok := h.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Error("request without credentials accepted")
+	}
+}
+
+func TestParseHtpasswdRejects(t *testing.T) {
+	tests := map[string]string{
+		"missing hash": "alice\n",
+		"empty user":   ":$apr1$abc$IIW/V525X46ri30NUi0KL0\n",
+		"crypt hash":   "alice:rl0uE4pZ7d6.s\n",
+		"plain text":   "alice:s3cret\n",
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseHtpasswd([]byte(contents)); err == nil {
+				t.Error("parseHtpasswd accepted the file")
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/credentials"
+)
+
+// Review results are cached so that a client's requests do not each cost an
+// API server round trip; rejections expire sooner so fixed tokens work quickly
+const (
+	reviewCacheTTL         = time.Minute
+	reviewNegativeCacheTTL = 10 * time.Second
+	maxReviewCache         = 4096
+)
+
+// tokenReview accepts bearer tokens that the Kubernetes API server of the
+// cluster the relay runs in authenticates, such as ServiceAccount tokens of a
+// central Prometheus. The relay's ServiceAccount needs to be allowed to create
+// tokenreviews, e.g. through the system:auth-delegator ClusterRole.
+type tokenReview struct {
+	source    *credentials.Source
+	client    *http.Client
+	audiences []string
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]reviewResult
+}
+
+// reviewResult is a cached TokenReview outcome
+type reviewResult struct {
+	username string
+	ok       bool
+	expires  time.Time
+}
+
+// newTokenReview returns an authenticator using the in-cluster API server
+func newTokenReview(audiences []string) (*tokenReview, error) {
+	source, err := credentials.InCluster()
+	if err != nil {
+		return nil, fmt.Errorf("TokenReview authentication requires running in a pod: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(source.CAData) {
+		return nil, fmt.Errorf("no certificates found in the ServiceAccount CA")
+	}
+	return &tokenReview{
+		source:    source,
+		audiences: audiences,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		},
+		cache: make(map[[sha256.Size]byte]reviewResult),
+	}, nil
+}
+
+// Authenticate accepts a bearer token the API server authenticates
+func (t *tokenReview) Authenticate(r *http.Request) (Identity, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return Identity{}, false
+	}
+
+	key := sha256.Sum256([]byte(token))
+	t.mu.Lock()
+	cached, ok := t.cache[key]
+	t.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return Identity{Name: cached.username, Method: MethodServiceAccount}, cached.ok
+	}
+
+	username, authenticated, err := t.review(r, token)
+	if err != nil {
+		// Not cached: the next request asks again
+		logger.Printf("TokenReview failed: %v", err)
+		return Identity{}, false
+	}
+
+	result := reviewResult{username: username, ok: authenticated, expires: time.Now().Add(reviewCacheTTL)}
+	if !authenticated {
+		result.expires = time.Now().Add(reviewNegativeCacheTTL)
+	}
+	t.mu.Lock()
+	if len(t.cache) >= maxReviewCache {
+		t.cache = make(map[[sha256.Size]byte]reviewResult)
+	}
+	t.cache[key] = result
+	t.mu.Unlock()
+
+	return Identity{Name: username, Method: MethodServiceAccount}, authenticated
+}
+
+// Challenge asks for a bearer token
+func (t *tokenReview) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", realm)
+}
+
+// review submits a TokenReview and returns the authenticated user name
+func (t *tokenReview) review(r *http.Request, token string) (string, bool, error) {
+	type tokenReviewSpec struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec":       tokenReviewSpec{Token: token, Audiences: t.audiences},
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST",
+		t.source.Endpoint+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return "", false, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.source.Credentials.Apply(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("API server returned status %d", resp.StatusCode)
+	}
+
+	var review struct {
+		Status struct {
+			Authenticated bool `json:"authenticated"`
+			User          struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return "", false, fmt.Errorf("error decoding TokenReview: %v", err)
+	}
+	return review.Status.User.Username, review.Status.Authenticated, nil
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tokenSet maps the SHA-256 of each accepted token to the client name. Looking
+// up hashes keeps the comparison independent of how much of a token matches.
+type tokenSet map[[sha256.Size]byte]string
+
+// staticTokens accepts a fixed list of bearer tokens, from the configuration
+// and from a file that is re-read when it changes
+type staticTokens struct {
+	tokens tokenSet
+	file   *watchedFile[tokenSet]
+}
+
+// newStaticTokens returns an authenticator for the given tokens and tokens file
+func newStaticTokens(tokens []string, path string) (*staticTokens, error) {
+	s := &staticTokens{tokens: make(tokenSet)}
+	for i, token := range tokens {
+		s.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))] = fmt.Sprintf("token-%d", i+1)
+	}
+	if path != "" {
+		file, err := newWatchedFile(path, parseTokens)
+		if err != nil {
+			return nil, fmt.Errorf("error reading inbound tokens file: %v", err)
+		}
+		s.file = file
+	}
+	return s, nil
+}
+
+// parseTokens reads one token per line, optionally followed by whitespace and
+// the client name. Empty lines and lines starting with # are ignored.
+func parseTokens(data []byte) (tokenSet, error) {
+	tokens := make(tokenSet)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := fmt.Sprintf("token-line-%d", line)
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		tokens[sha256.Sum256([]byte(fields[0]))] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Authenticate accepts a bearer token from the list
+func (s *staticTokens) Authenticate(r *http.Request) (Identity, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return Identity{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	if name, ok := s.tokens[sum]; ok {
+		return Identity{Name: name, Method: MethodToken}, true
+	}
+	if s.file != nil {
+		if name, ok := s.file.get()[sum]; ok {
+			return Identity{Name: name, Method: MethodToken}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// Challenge asks for a bearer token
+func (s *staticTokens) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", realm)
+}
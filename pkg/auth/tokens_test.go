@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// bearer returns a request carrying token as a bearer token
+func bearer(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestStaticTokens(t *testing.T) {
+	path := writeFile(t, "tokens", "# clients\nfile-token grafana\n\n  unnamed-token  \n")
+	s, err := newStaticTokens([]string{"env-token", " padded-token "}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		name  string
+	}{
+		{"env-token", "token-1"},
+		{"padded-token", "token-2"},
+		{"file-token", "grafana"},
+		{"unnamed-token", "token-line-4"},
+		{"unknown", ""},
+		{"#", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			id, ok := s.Authenticate(bearer(tt.token))
+			if ok != (tt.name != "") {
+				t.Fatalf("Authenticate = %v", ok)
+			}
+			if ok && id != (Identity{Name: tt.name, Method: MethodToken}) {
+				t.Errorf("identity = %+v, want %s", id, tt.name)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("env-token", "")
+	if _, ok := s.Authenticate(r); ok {
+		t.Error("Basic credentials accepted as a token")
+	}
+}
+
+func TestStaticTokensReload(t *testing.T) {
+	path := writeFile(t, "tokens", "old-token grafana\n")
+	s, err := newStaticTokens(nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// recheck lets the next request look at the file again
+	recheck := func() {
+		s.file.mu.Lock()
+		s.file.checked = time.Time{}
+		s.file.mu.Unlock()
+	}
+
+	if err := os.WriteFile(path, []byte("new-token grafana\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Authenticate(bearer("old-token")); !ok {
+		t.Error("file re-read before the check interval passed")
+	}
+
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	recheck()
+	if _, ok := s.Authenticate(bearer("new-token")); !ok {
+		t.Error("new token rejected after the file changed")
+	}
+	if _, ok := s.Authenticate(bearer("old-token")); ok {
+		t.Error("old token accepted after the file changed")
+	}
+
+	// A file that can no longer be read keeps the previous tokens
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	recheck()
+	if _, ok := s.Authenticate(bearer("new-token")); !ok {
+		t.Error("tokens dropped when the file disappeared")
+	}
+}
+
+func TestNewStaticTokensMissingFile(t *testing.T) {
+	if _, err := newStaticTokens(nil, writeFile(t, "tokens", "")+".missing"); err == nil {
+		t.Error("missing tokens file accepted")
+	}
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// Cluster represents a downstream Rancher cluster the relay forwards requests to
+type Cluster struct {
+	ID     string
+	Name   string
+	State  string
+	Labels map[string]string
+}
+
+// DisplayName returns the cluster name, falling back to the cluster ID
+func (c Cluster) DisplayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
+}
+
+// Registry holds the set of clusters currently relayed by this process
+type Registry struct {
+	mu          sync.RWMutex
+	clusters    map[string]Cluster
+	removeHooks []func(Cluster)
+}
+
+// Default is the registry used by the proxy, health and metrics handlers
+var Default = NewRegistry()
+
+// NewRegistry returns an empty cluster registry
+func NewRegistry() *Registry {
+	return &Registry{clusters: make(map[string]Cluster)}
+}
+
+// LoadFromConfig replaces the registry contents with the clusters from cfg and
+// returns the clusters that were added or removed
+func (r *Registry) LoadFromConfig(cfg config.Config) (added, removed []Cluster) {
+	targets := cfg.ClusterTargets()
+	clusters := make([]Cluster, 0, len(targets))
+	for _, target := range targets {
+		clusters = append(clusters, Cluster{ID: target.ID, Name: target.Name})
+	}
+	return r.Sync(clusters)
+}
+
+// OnRemove registers fn to be called with every cluster Sync removes
+func (r *Registry) OnRemove(fn func(Cluster)) {
+	r.mu.Lock()
+	r.removeHooks = append(r.removeHooks, fn)
+	r.mu.Unlock()
+}
+
+// Sync swaps the registry contents for the given clusters and returns the
+// clusters that were added or removed. A cluster whose name changed is
+// reported as added.
+func (r *Registry) Sync(clusters []Cluster) (added, removed []Cluster) {
+	next := make(map[string]Cluster, len(clusters))
+	for _, c := range clusters {
+		next[c.ID] = c
+	}
+
+	r.mu.Lock()
+	for id, c := range next {
+		if previous, ok := r.clusters[id]; !ok || previous.Name != c.Name {
+			added = append(added, c)
+		}
+	}
+	for id, c := range r.clusters {
+		if _, ok := next[id]; !ok {
+			removed = append(removed, c)
+		}
+	}
+	r.clusters = next
+	hooks := append([]func(Cluster){}, r.removeHooks...)
+	r.mu.Unlock()
+
+	for _, c := range removed {
+		for _, hook := range hooks {
+			hook(c)
+		}
+	}
+	return added, removed
+}
+
+// Lookup finds a cluster by ID or, failing that, by name
+func (r *Registry) Lookup(idOrName string) (Cluster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if c, ok := r.clusters[idOrName]; ok {
+		return c, true
+	}
+	for _, c := range r.clusters {
+		if c.Name != "" && c.Name == idOrName {
+			return c, true
+		}
+	}
+	return Cluster{}, false
+}
+
+// List returns all registered clusters sorted by ID
+func (r *Registry) List() []Cluster {
+	r.mu.RLock()
+	clusters := make([]Cluster, 0, len(r.clusters))
+	for _, c := range r.clusters {
+		clusters = append(clusters, c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].ID < clusters[j].ID })
+	return clusters
+}
+
+// Only returns the registered cluster when exactly one is configured
+func (r *Registry) Only() (Cluster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.clusters) != 1 {
+		return Cluster{}, false
+	}
+	for _, c := range r.clusters {
+		return c, true
+	}
+	return Cluster{}, false
+}
@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
+)
+
+var logger = logging.SetupLogging()
+
+// localClusterID is the ID Rancher gives the cluster it runs in
+const localClusterID = "local"
+
+// rancherClusterList is the subset of a page of the Rancher /v3/clusters
+// response used for discovery. Pagination.Next links the following page and
+// is empty on the last one.
+type rancherClusterList struct {
+	Data []struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		State  string            `json:"state"`
+		Labels map[string]string `json:"labels"`
+	} `json:"data"`
+	Pagination struct {
+		Next string `json:"next"`
+	} `json:"pagination"`
+}
+
+// Discoverer periodically lists clusters from the Rancher management API and
+// keeps a Registry in sync with the clusters that pass the configured filters.
+type Discoverer struct {
+	registry *Registry
+	cfg      config.Config
+	selector config.LabelSelector
+	nameExpr *regexp.Regexp
+	states   map[string]bool
+
+	staticMu sync.RWMutex
+	static   []Cluster
+}
+
+// NewDiscoverer builds a Discoverer from the discovery settings in cfg.
+// Clusters listed statically in cfg are always kept in the registry.
+func NewDiscoverer(cfg config.Config, registry *Registry) (*Discoverer, error) {
+	if cfg.DirectClusterAPI {
+		return nil, fmt.Errorf("cluster discovery requires the Rancher API and cannot be used in direct cluster mode")
+	}
+
+	selector, err := config.ParseLabelSelector(cfg.DiscoveryLabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISCOVERY_LABEL_SELECTOR: %v", err)
+	}
+
+	var nameExpr *regexp.Regexp
+	if cfg.DiscoveryNameRegex != "" {
+		nameExpr, err = regexp.Compile(cfg.DiscoveryNameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISCOVERY_NAME_REGEX: %v", err)
+		}
+	}
+
+	states := make(map[string]bool, len(cfg.DiscoveryStates))
+	for _, state := range cfg.DiscoveryStates {
+		states[state] = true
+	}
+
+	d := &Discoverer{
+		registry: registry,
+		cfg:      cfg,
+		selector: selector,
+		nameExpr: nameExpr,
+		states:   states,
+	}
+	d.SetStatic(cfg.ClusterTargets())
+	return d, nil
+}
+
+// SetStatic replaces the statically configured clusters kept on every sync
+func (d *Discoverer) SetStatic(targets []config.ClusterTarget) {
+	static := make([]Cluster, 0, len(targets))
+	for _, target := range targets {
+		static = append(static, Cluster{ID: target.ID, Name: target.Name})
+	}
+
+	d.staticMu.Lock()
+	d.static = static
+	d.staticMu.Unlock()
+}
+
+// Run syncs the registry every DiscoveryInterval until ctx is cancelled
+func (d *Discoverer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Sync(ctx); err != nil {
+				logger.Printf("Cluster discovery failed, keeping current clusters: %v", err)
+			}
+		}
+	}
+}
+
+// Sync lists the clusters from Rancher once and updates the registry
+func (d *Discoverer) Sync(ctx context.Context) error {
+	discovered, err := d.listClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.staticMu.RLock()
+	clusters := append([]Cluster{}, d.static...)
+	d.staticMu.RUnlock()
+	for _, c := range discovered {
+		if d.matches(c) {
+			clusters = append(clusters, c)
+		}
+	}
+
+	added, removed := d.registry.Sync(clusters)
+	for _, c := range added {
+		logger.Printf("Cluster discovery: relaying cluster %s (%s)", c.ID, c.DisplayName())
+	}
+	for _, c := range removed {
+		logger.Printf("Cluster discovery: stopped relaying cluster %s (%s)", c.ID, c.DisplayName())
+	}
+	return nil
+}
+
+// matches reports whether a discovered cluster passes the configured filters
+func (d *Discoverer) matches(c Cluster) bool {
+	if c.ID == localClusterID && !d.cfg.DiscoveryIncludeLocal {
+		return false
+	}
+	if len(d.states) > 0 && !d.states[c.State] {
+		return false
+	}
+	if d.nameExpr != nil && !d.nameExpr.MatchString(c.Name) {
+		return false
+	}
+	return d.selector.Matches(c.Labels)
+}
+
+// listClusters fetches all clusters visible to the configured Rancher
+// credentials, following the pagination links until the last page. A failure
+// on any page fails the whole listing so that clusters on the missing pages
+// are not removed from the registry.
+func (d *Discoverer) listClusters(ctx context.Context) ([]Cluster, error) {
+	client := transport.NewClient(transport.RancherUpstream, 30*time.Second)
+
+	var clusters []Cluster
+	seen := make(map[string]bool)
+	for url := strings.TrimSuffix(d.cfg.RancherApiEndpoint, "/") + "/v3/clusters"; url != ""; {
+		if seen[url] {
+			return nil, fmt.Errorf("cluster list pagination returned %s twice", url)
+		}
+		seen[url] = true
+
+		list, err := d.fetchClusterPage(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Data {
+			clusters = append(clusters, Cluster{
+				ID:     item.ID,
+				Name:   item.Name,
+				State:  item.State,
+				Labels: item.Labels,
+			})
+		}
+		url = list.Pagination.Next
+	}
+	return clusters, nil
+}
+
+// fetchClusterPage fetches a single page of the cluster list
+func (d *Discoverer) fetchClusterPage(ctx context.Context, client *http.Client, url string) (*rancherClusterList, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing clusters: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing clusters failed, status code: %d", resp.StatusCode)
+	}
+
+	var list rancherClusterList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error decoding cluster list: %v", err)
+	}
+	return &list, nil
+}
@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// rancherCluster is a cluster served by the fake Rancher API
+type rancherCluster struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	State  string            `json:"state"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// fakeRancher serves clusters from /v3/clusters, pageSize per page. A page
+// listed in failPages answers 500.
+func fakeRancher(t *testing.T, clusters []rancherCluster, pageSize int, failPages ...string) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/clusters" {
+			http.NotFound(w, r)
+			return
+		}
+		marker := r.URL.Query().Get("marker")
+		for _, page := range failPages {
+			if page == marker {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		start := 0
+		for i, c := range clusters {
+			if c.ID == marker {
+				start = i
+			}
+		}
+		end := start + pageSize
+		var next string
+		if end < len(clusters) {
+			next = server.URL + "/v3/clusters?marker=" + clusters[end].ID
+		} else {
+			end = len(clusters)
+		}
+
+		page := map[string]interface{}{
+			"data":       clusters[start:end],
+			"pagination": map[string]interface{}{"next": next, "limit": pageSize},
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// discover runs a single discovery sync with cfg against server and returns
+// the IDs of the clusters in the registry
+func discover(t *testing.T, server *httptest.Server, cfg config.Config, registry *Registry) ([]string, error) {
+	t.Helper()
+	cfg.RancherApiEndpoint = server.URL
+	d, err := NewDiscoverer(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = d.Sync(ctx)
+
+	var ids []string
+	for _, c := range registry.List() {
+		ids = append(ids, c.ID)
+	}
+	return ids, err
+}
+
+var testClusters = []rancherCluster{
+	{ID: "c-1", Name: "prod-west", State: "active", Labels: map[string]string{"env": "prod"}},
+	{ID: "c-2", Name: "prod-east", State: "active", Labels: map[string]string{"env": "prod", "region": "east"}},
+	{ID: "c-3", Name: "staging", State: "active", Labels: map[string]string{"env": "staging"}},
+	{ID: "c-4", Name: "prod-new", State: "provisioning", Labels: map[string]string{"env": "prod"}},
+	{ID: "c-5", Name: "dev", State: "unavailable"},
+	{ID: "local", Name: "local", State: "active"},
+}
+
+func TestDiscoveryFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want []string
+	}{
+		{
+			name: "active clusters without local",
+			cfg:  config.Config{DiscoveryStates: []string{"active"}},
+			want: []string{"c-1", "c-2", "c-3"},
+		},
+		{
+			name: "include local",
+			cfg:  config.Config{DiscoveryStates: []string{"active"}, DiscoveryIncludeLocal: true},
+			want: []string{"c-1", "c-2", "c-3", "local"},
+		},
+		{
+			name: "several states",
+			cfg:  config.Config{DiscoveryStates: []string{"active", "provisioning"}},
+			want: []string{"c-1", "c-2", "c-3", "c-4"},
+		},
+		{
+			name: "any state",
+			cfg:  config.Config{},
+			want: []string{"c-1", "c-2", "c-3", "c-4", "c-5"},
+		},
+		{
+			name: "name regex",
+			cfg:  config.Config{DiscoveryNameRegex: "^prod-", DiscoveryStates: []string{"active"}},
+			want: []string{"c-1", "c-2"},
+		},
+		{
+			name: "label selector",
+			cfg:  config.Config{DiscoveryLabelSelector: "env=prod,region!=east"},
+			want: []string{"c-1", "c-4"},
+		},
+		{
+			name: "label selector with existence",
+			cfg:  config.Config{DiscoveryLabelSelector: "region"},
+			want: []string{"c-2"},
+		},
+		{
+			name: "static clusters are kept",
+			cfg:  config.Config{DiscoveryNameRegex: "^staging$", Clusters: []config.ClusterTarget{{ID: "c-static"}}},
+			want: []string{"c-3", "c-static"},
+		},
+	}
+
+	server := fakeRancher(t, testClusters, 100)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discover(t, server, tt.cfg, NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discovered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryFollowsPagination(t *testing.T) {
+	server := fakeRancher(t, testClusters, 2)
+	got, err := discover(t, server, config.Config{DiscoveryIncludeLocal: true}, NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"c-1", "c-2", "c-3", "c-4", "c-5", "local"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discovered %v, want %v", got, want)
+	}
+}
+
+func TestDiscoveryKeepsClustersWhenAPageFails(t *testing.T) {
+	registry := NewRegistry()
+	registry.Sync([]Cluster{{ID: "c-1"}, {ID: "c-3"}, {ID: "c-5"}})
+
+	server := fakeRancher(t, testClusters, 2, "c-3")
+	got, err := discover(t, server, config.Config{}, registry)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Sync error = %v, want the failed page", err)
+	}
+	if want := []string{"c-1", "c-3", "c-5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registry holds %v after a failed sync, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in access profiles
+const (
+	PrometheusReadOnlyProfile = "prometheus-readonly"
+	LokiReadOnlyProfile       = "loki-readonly"
+	LokiPushOnlyProfile       = "loki-push-only"
+)
+
+// AccessRule matches requests by method and path. No methods matches every
+// method. In Path, "*" matches within one path segment and "**" matches any
+// number of segments; a trailing "/**" also matches the path without it.
+type AccessRule struct {
+	Methods []string
+	Path    string
+}
+
+// AccessPolicy restricts which requests are relayed to an upstream. Deny rules
+// are checked first; when there are allow rules a request must match one of them.
+// The rules of Profile come before the policy's own.
+type AccessPolicy struct {
+	Profile string
+	Allow   []AccessRule
+	Deny    []AccessRule
+}
+
+// readMethods are the methods that never change upstream state
+var readMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// AccessProfiles are the built-in policies selectable by name
+var AccessProfiles = map[string]AccessPolicy{
+	// Queries, metadata and the UI; no admin API, reload, quit or remote write
+	PrometheusReadOnlyProfile: {
+		Allow: []AccessRule{
+			{Methods: readMethods, Path: "/**"},
+			{Methods: []string{"POST"}, Path: "/api/v1/query"},
+			{Methods: []string{"POST"}, Path: "/api/v1/query_range"},
+			{Methods: []string{"POST"}, Path: "/api/v1/query_exemplars"},
+			{Methods: []string{"POST"}, Path: "/api/v1/series"},
+			{Methods: []string{"POST"}, Path: "/api/v1/labels"},
+			{Methods: []string{"POST"}, Path: "/api/v1/format_query"},
+			{Methods: []string{"POST"}, Path: "/api/v1/parse_query"},
+			{Methods: []string{"POST"}, Path: "/api/v1/read"},
+		},
+		Deny: []AccessRule{
+			{Path: "/api/v1/admin/**"},
+			{Path: "/-/reload"},
+			{Path: "/-/quit"},
+		},
+	},
+	// Queries, labels, series and tail; no push, deletes or ingester operations
+	LokiReadOnlyProfile: {
+		Allow: []AccessRule{
+			{Methods: readMethods, Path: "/**"},
+			{Methods: []string{"POST"}, Path: "/loki/api/v1/query"},
+			{Methods: []string{"POST"}, Path: "/loki/api/v1/query_range"},
+			{Methods: []string{"POST"}, Path: "/loki/api/v1/series"},
+			{Methods: []string{"POST"}, Path: "/loki/api/v1/index/*"},
+		},
+		Deny: []AccessRule{
+			{Path: "/loki/api/v1/push"},
+			{Path: "/api/prom/push"},
+			{Path: "/otlp/**"},
+			{Path: "/loki/api/v1/delete/**"},
+			{Path: "/compactor/**"},
+			{Path: "/ingester/**"},
+			{Path: "/flush"},
+		},
+	},
+	// Log shipping only, e.g. for agents in other clusters
+	LokiPushOnlyProfile: {
+		Allow: []AccessRule{
+			{Methods: []string{"POST"}, Path: "/loki/api/v1/push"},
+			{Methods: []string{"POST"}, Path: "/api/prom/push"},
+			{Methods: []string{"POST"}, Path: "/otlp/v1/logs"},
+		},
+	},
+}
+
+// AccessProfileNames returns the names of the built-in profiles, sorted
+func AccessProfileNames() []string {
+	names := make([]string, 0, len(AccessProfiles))
+	for name := range AccessProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rules returns the allow and deny rules in effect: the profile's followed by
+// the policy's own
+func (p AccessPolicy) Rules() (allow, deny []AccessRule) {
+	profile := AccessProfiles[p.Profile]
+	allow = append(append(allow, profile.Allow...), p.Allow...)
+	deny = append(append(deny, profile.Deny...), p.Deny...)
+	return allow, deny
+}
+
+// Restricted reports whether the policy limits any request
+func (p AccessPolicy) Restricted() bool {
+	allow, deny := p.Rules()
+	return len(allow) > 0 || len(deny) > 0
+}
+
+// httpMethod matches an HTTP method name
+var httpMethod = regexp.MustCompile(`^[A-Za-z]+$`)
+
+// validateAccess returns the problems of an upstream's access policy. env names
+// the variable selecting the profile, if any.
+func validateAccess(field, env string, p AccessPolicy) []string {
+	var problems []string
+	if p.Profile != "" {
+		if _, ok := AccessProfiles[p.Profile]; !ok {
+			name := field + ".profile"
+			if env != "" {
+				name += " (" + env + ")"
+			}
+			problems = append(problems, fmt.Sprintf("%s %q must be one of %s", name, p.Profile, strings.Join(AccessProfileNames(), ", ")))
+		}
+	}
+	for _, list := range []struct {
+		kind  string
+		rules []AccessRule
+	}{{"allow", p.Allow}, {"deny", p.Deny}} {
+		for i, rule := range list.rules {
+			if !strings.HasPrefix(rule.Path, "/") {
+				problems = append(problems, fmt.Sprintf("%s.%s[%d] path %q must start with /", field, list.kind, i, rule.Path))
+			}
+			for _, method := range rule.Methods {
+				if !httpMethod.MatchString(method) {
+					problems = append(problems, fmt.Sprintf("%s.%s[%d] method %q is not an HTTP method", field, list.kind, i, method))
+				}
+			}
+		}
+	}
+	return problems
+}
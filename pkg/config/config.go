@@ -1,67 +1,353 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Config struct {
-	Debug                      bool
-	MetricsPort                string
-	RancherApiEndpoint         string
-	RancherApiAccessKey        string
-	RancherApiSecretKey        string
-	ClusterId                  string
-	ClusterName                string
-	RancherInsecureSkipVerify  bool
+	Debug                     bool
+	MetricsPort               string
+	RancherApiEndpoint        string
+	RancherApiAccessKey       string
+	RancherApiSecretKey       string
+	ClusterId                 string
+	ClusterName               string
+	RancherInsecureSkipVerify bool
+
+	// Rancher authentication configuration
+	RancherAuthType           string
+	RancherApiAccessKeyFile   string
+	RancherApiSecretKeyFile   string
+	RancherApiToken           string
+	RancherApiTokenFile       string
+	RancherKubeconfig         string
+	RancherKubeconfigContext  string
+	DirectClusterAPI          bool
+	CredentialsReloadInterval time.Duration
+
+	// How often the config file is checked for changes; SIGHUP always reloads it
+	ConfigReloadInterval time.Duration
+
+	// Rancher TLS configuration
+	RancherCAFile         string
+	RancherCAPEM          string
+	RancherClientCertFile string
+	RancherClientKeyFile  string
+	RancherTLSMinVersion  string
+	RancherTLSServerName  string
+
+	// Upstream connection pool configuration
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamMaxConnsPerHost     int
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamHTTP2               bool
+	UpstreamDialTimeout         time.Duration
+	UpstreamTLSHandshakeTimeout time.Duration
+
+	// Multi-cluster relay configuration
+	Clusters       []ClusterTarget
+	ClusterRouting string
+
+	// Cluster discovery configuration
+	DiscoveryEnabled       bool
+	DiscoveryInterval      time.Duration
+	DiscoveryLabelSelector string
+	DiscoveryNameRegex     string
+	DiscoveryStates        []string
+	DiscoveryIncludeLocal  bool
+
+	// Service discovery configuration. Prometheus targets are scraped through
+	// /federate with SDFederateMatch as the match[] selector.
+	SDTargetHost    string
+	SDFederateMatch string
+
+	// Serve every upstream under a path of the metrics port instead of its own listener
+	SinglePort bool
+
+	// Listener configuration. Ports also accept host:port or unix:/path/to/socket.
+	ListenAddress         string
+	PrometheusListenPort  string
+	LokiListenPort        string
+	ListenerTLSCertFile   string
+	ListenerTLSKeyFile    string
+	ListenerTLSMinVersion string
+
+	// Graceful shutdown: /ready fails for the drain delay before the listeners
+	// stop, then in-flight requests get up to the timeout to finish
+	ShutdownDrainDelay time.Duration
+	ShutdownTimeout    time.Duration
+
+	// Background health checks of Rancher and every upstream served by /health
+	// and /ready. A check changes state after the given number of consecutive
+	// failures or successes.
+	HealthProbeInterval    time.Duration
+	HealthProbeTimeout     time.Duration
+	HealthFailureThreshold int
+	HealthSuccessThreshold int
+
+	// /ready succeeds while at least this many clusters are ready, or all of
+	// them when fewer are relayed
+	ReadyMinClusters int
+
+	// Inbound authentication of clients of the proxy and query endpoints
+	InboundAuthTokens               []string
+	InboundAuthTokensFile           string
+	InboundAuthHtpasswdFile         string
+	InboundAuthClientCAFile         string
+	InboundAuthTokenReview          bool
+	InboundAuthTokenReviewAudiences []string
 
 	// Prometheus configuration
 	PrometheusNamespace string
 	PrometheusService   string
 	PrometheusPort      string
+	PrometheusAccess    AccessPolicy
+	PrometheusReadiness string
+
+	// Add cluster_id/cluster_name labels to series served from /federate
+	FederateClusterLabels bool
+
+	// Restrict clients to the series of their tenant
+	PrometheusTenants []Tenant
 
 	// Loki configuration
 	LokiNamespace string
 	LokiService   string
 	LokiPort      string
+	LokiAccess    AccessPolicy
+	LokiReadiness string
+
+	// X-Scope-OrgID sent to Loki, with {cluster_id} and {cluster_name} replaced.
+	// Tenants may override it; clients cannot choose their own once either is set.
+	LokiOrgID   string
+	LokiTenants []Tenant
 
 	// Generic remote endpoint configuration
 	RemoteNamespace string
 	RemoteService   string
 	RemotePort      string
+	RemoteAccess    AccessPolicy
+	RemoteReadiness string
+
+	// Additional upstreams declared in the config file
+	CustomUpstreams []Upstream
 }
 
+// ClusterTarget identifies a downstream Rancher cluster relayed by this process
+type ClusterTarget struct {
+	ID   string
+	Name string
+}
+
+// CFG is the configuration the process started with. Settings that can change
+// on reload must be read through Current instead.
 var CFG Config
 
-func LoadConfigFromEnv() Config {
-	config := Config{
-		Debug:                     parseEnvBool("DEBUG"),
-		MetricsPort:               getEnvOrDefault("METRICS_PORT", "9000"),
-		RancherApiEndpoint:        getEnvOrDefault("RANCHER_API_ENDPOINT", ""),
-		RancherApiAccessKey:       getEnvOrDefault("RANCHER_API_ACCESS_KEY", ""),
-		RancherApiSecretKey:       getEnvOrDefault("RANCHER_API_SECRET_KEY", ""),
-		ClusterId:                 getEnvOrDefault("CLUSTER_ID", ""),
-		ClusterName:               getEnvOrDefault("CLUSTER_NAME", ""),
-		RancherInsecureSkipVerify: parseEnvBool("RANCHER_INSECURE_SKIP_VERIFY"),
-
-		// Prometheus configuration
-		PrometheusNamespace: getEnvOrDefault("PROMETHEUS_NAMESPACE", "cattle-monitoring-system"),
-		PrometheusService:   getEnvOrDefault("PROMETHEUS_SERVICE", "rancher-monitoring-prometheus"),
-		PrometheusPort:      getEnvOrDefault("PROMETHEUS_PORT", "9090"),
-
-		// Loki configuration
-		LokiNamespace: getEnvOrDefault("LOKI_NAMESPACE", "cattle-logging-system"),
-		LokiService:   getEnvOrDefault("LOKI_SERVICE", "rancher-logging-loki"),
-		LokiPort:      getEnvOrDefault("LOKI_PORT", "3100"),
-
-		// Generic remote endpoint configuration
-		RemoteNamespace: getEnvOrDefault("REMOTE_NAMESPACE", ""),
-		RemoteService:   getEnvOrDefault("REMOTE_SERVICE", ""),
-		RemotePort:      getEnvOrDefault("REMOTE_PORT", ""),
+// current is the configuration in effect, swapped atomically on reload
+var current atomic.Pointer[Config]
+
+// Current returns the configuration in effect. It is safe to call while the
+// config file is being reloaded.
+func Current() Config {
+	if c := current.Load(); c != nil {
+		return *c
+	}
+	return CFG
+}
+
+// Set publishes c as the configuration in effect
+func Set(c Config) {
+	current.Store(&c)
+}
+
+// Defaults returns the configuration used for every setting that is neither in
+// the config file nor in the environment
+func Defaults() Config {
+	return Config{
+		MetricsPort:                 "9000",
+		PrometheusListenPort:        "9090",
+		LokiListenPort:              "3100",
+		ListenerTLSMinVersion:       "1.2",
+		ShutdownDrainDelay:          5 * time.Second,
+		ShutdownTimeout:             20 * time.Second,
+		HealthProbeInterval:         15 * time.Second,
+		HealthProbeTimeout:          10 * time.Second,
+		HealthFailureThreshold:      3,
+		HealthSuccessThreshold:      1,
+		ReadyMinClusters:            1,
+		CredentialsReloadInterval:   30 * time.Second,
+		ConfigReloadInterval:        10 * time.Second,
+		RancherTLSMinVersion:        "1.2",
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: 20,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamDialTimeout:         30 * time.Second,
+		UpstreamTLSHandshakeTimeout: 10 * time.Second,
+		ClusterRouting:              "path",
+		SDFederateMatch:             `{job=~".+"}`,
+		DiscoveryInterval:           60 * time.Second,
+		DiscoveryStates:             []string{"active"},
+		PrometheusNamespace:         "cattle-monitoring-system",
+		PrometheusService:           "rancher-monitoring-prometheus",
+		PrometheusPort:              "9090",
+		LokiNamespace:               "cattle-logging-system",
+		LokiService:                 "rancher-logging-loki",
+		LokiPort:                    "3100",
+	}
+}
+
+// applyEnv overrides the settings in c whose environment variable is set and
+// returns a problem for every value that cannot be parsed
+func applyEnv(c *Config) []string {
+	var problems []string
+	c.Debug = parseEnvBool("DEBUG", c.Debug)
+	c.MetricsPort = getEnvOrDefault("METRICS_PORT", c.MetricsPort)
+	c.RancherApiEndpoint = getEnvOrDefault("RANCHER_API_ENDPOINT", c.RancherApiEndpoint)
+	c.RancherApiAccessKey = getEnvOrDefault("RANCHER_API_ACCESS_KEY", c.RancherApiAccessKey)
+	c.RancherApiSecretKey = getEnvOrDefault("RANCHER_API_SECRET_KEY", c.RancherApiSecretKey)
+	c.ClusterId = getEnvOrDefault("CLUSTER_ID", c.ClusterId)
+	c.ClusterName = getEnvOrDefault("CLUSTER_NAME", c.ClusterName)
+	c.RancherInsecureSkipVerify = parseEnvBool("RANCHER_INSECURE_SKIP_VERIFY", c.RancherInsecureSkipVerify)
+
+	// Rancher authentication configuration
+	c.RancherAuthType = getEnvOrDefault("RANCHER_AUTH_TYPE", c.RancherAuthType)
+	c.RancherApiAccessKeyFile = getEnvOrDefault("RANCHER_API_ACCESS_KEY_FILE", c.RancherApiAccessKeyFile)
+	c.RancherApiSecretKeyFile = getEnvOrDefault("RANCHER_API_SECRET_KEY_FILE", c.RancherApiSecretKeyFile)
+	c.RancherApiToken = getEnvOrDefault("RANCHER_API_TOKEN", c.RancherApiToken)
+	c.RancherApiTokenFile = getEnvOrDefault("RANCHER_API_TOKEN_FILE", c.RancherApiTokenFile)
+	c.RancherKubeconfig = getEnvOrDefault("RANCHER_KUBECONFIG", c.RancherKubeconfig)
+	c.RancherKubeconfigContext = getEnvOrDefault("RANCHER_KUBECONFIG_CONTEXT", c.RancherKubeconfigContext)
+	c.DirectClusterAPI = parseEnvBool("DIRECT_CLUSTER_API", c.DirectClusterAPI)
+	c.CredentialsReloadInterval = parseEnvDuration("CREDENTIALS_RELOAD_INTERVAL", c.CredentialsReloadInterval, &problems)
+	c.ConfigReloadInterval = parseEnvDuration("CONFIG_RELOAD_INTERVAL", c.ConfigReloadInterval, &problems)
+
+	// Rancher TLS configuration
+	c.RancherCAFile = getEnvOrDefault("RANCHER_CA_FILE", c.RancherCAFile)
+	c.RancherCAPEM = getEnvOrDefault("RANCHER_CA_PEM", c.RancherCAPEM)
+	c.RancherClientCertFile = getEnvOrDefault("RANCHER_CLIENT_CERT_FILE", c.RancherClientCertFile)
+	c.RancherClientKeyFile = getEnvOrDefault("RANCHER_CLIENT_KEY_FILE", c.RancherClientKeyFile)
+	c.RancherTLSMinVersion = getEnvOrDefault("RANCHER_TLS_MIN_VERSION", c.RancherTLSMinVersion)
+	c.RancherTLSServerName = getEnvOrDefault("RANCHER_TLS_SERVER_NAME", c.RancherTLSServerName)
+
+	// Upstream connection pool configuration
+	c.UpstreamMaxIdleConns = parseEnvInt("UPSTREAM_MAX_IDLE_CONNS", c.UpstreamMaxIdleConns, &problems)
+	c.UpstreamMaxIdleConnsPerHost = parseEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", c.UpstreamMaxIdleConnsPerHost, &problems)
+	c.UpstreamMaxConnsPerHost = parseEnvInt("UPSTREAM_MAX_CONNS_PER_HOST", c.UpstreamMaxConnsPerHost, &problems)
+	c.UpstreamIdleConnTimeout = parseEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", c.UpstreamIdleConnTimeout, &problems)
+	c.UpstreamHTTP2 = parseEnvBool("UPSTREAM_HTTP2", c.UpstreamHTTP2)
+	c.UpstreamDialTimeout = parseEnvDuration("UPSTREAM_DIAL_TIMEOUT", c.UpstreamDialTimeout, &problems)
+	c.UpstreamTLSHandshakeTimeout = parseEnvDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", c.UpstreamTLSHandshakeTimeout, &problems)
+
+	// Multi-cluster relay configuration
+	c.Clusters = parseEnvClusters("CLUSTERS", c.Clusters)
+	c.ClusterRouting = getEnvOrDefault("CLUSTER_ROUTING", c.ClusterRouting)
+
+	// Cluster discovery configuration
+	c.DiscoveryEnabled = parseEnvBool("DISCOVERY_ENABLED", c.DiscoveryEnabled)
+	c.DiscoveryInterval = parseEnvDuration("DISCOVERY_INTERVAL", c.DiscoveryInterval, &problems)
+	c.DiscoveryLabelSelector = getEnvOrDefault("DISCOVERY_LABEL_SELECTOR", c.DiscoveryLabelSelector)
+	c.DiscoveryNameRegex = getEnvOrDefault("DISCOVERY_NAME_REGEX", c.DiscoveryNameRegex)
+	c.DiscoveryStates = parseEnvList("DISCOVERY_STATES", c.DiscoveryStates)
+	c.DiscoveryIncludeLocal = parseEnvBool("DISCOVERY_INCLUDE_LOCAL", c.DiscoveryIncludeLocal)
+
+	// Service discovery configuration
+	c.SDTargetHost = getEnvOrDefault("SD_TARGET_HOST", c.SDTargetHost)
+	c.SDFederateMatch = getEnvOrDefault("SD_FEDERATE_MATCH", c.SDFederateMatch)
+	c.SinglePort = parseEnvBool("SINGLE_PORT", c.SinglePort)
+
+	// Listener configuration
+	c.ListenAddress = getEnvOrDefault("LISTEN_ADDRESS", c.ListenAddress)
+	c.PrometheusListenPort = getEnvOrDefault("PROMETHEUS_LISTEN_PORT", c.PrometheusListenPort)
+	c.LokiListenPort = getEnvOrDefault("LOKI_LISTEN_PORT", c.LokiListenPort)
+	c.ListenerTLSCertFile = getEnvOrDefault("LISTEN_TLS_CERT_FILE", c.ListenerTLSCertFile)
+	c.ListenerTLSKeyFile = getEnvOrDefault("LISTEN_TLS_KEY_FILE", c.ListenerTLSKeyFile)
+	c.ListenerTLSMinVersion = getEnvOrDefault("LISTEN_TLS_MIN_VERSION", c.ListenerTLSMinVersion)
+	c.ShutdownDrainDelay = parseEnvDuration("SHUTDOWN_DRAIN_DELAY", c.ShutdownDrainDelay, &problems)
+	c.ShutdownTimeout = parseEnvDuration("SHUTDOWN_TIMEOUT", c.ShutdownTimeout, &problems)
+
+	// Health checks
+	c.HealthProbeInterval = parseEnvDuration("HEALTH_PROBE_INTERVAL", c.HealthProbeInterval, &problems)
+	c.HealthProbeTimeout = parseEnvDuration("HEALTH_PROBE_TIMEOUT", c.HealthProbeTimeout, &problems)
+	c.HealthFailureThreshold = parseEnvInt("HEALTH_FAILURE_THRESHOLD", c.HealthFailureThreshold, &problems)
+	c.HealthSuccessThreshold = parseEnvInt("HEALTH_SUCCESS_THRESHOLD", c.HealthSuccessThreshold, &problems)
+	c.ReadyMinClusters = parseEnvInt("READY_MIN_CLUSTERS", c.ReadyMinClusters, &problems)
+
+	// Inbound authentication
+	c.InboundAuthTokens = parseEnvList("INBOUND_AUTH_TOKENS", c.InboundAuthTokens)
+	c.InboundAuthTokensFile = getEnvOrDefault("INBOUND_AUTH_TOKENS_FILE", c.InboundAuthTokensFile)
+	c.InboundAuthHtpasswdFile = getEnvOrDefault("INBOUND_AUTH_HTPASSWD_FILE", c.InboundAuthHtpasswdFile)
+	c.InboundAuthClientCAFile = getEnvOrDefault("INBOUND_AUTH_CLIENT_CA_FILE", c.InboundAuthClientCAFile)
+	c.InboundAuthTokenReview = parseEnvBool("INBOUND_AUTH_TOKEN_REVIEW", c.InboundAuthTokenReview)
+	c.InboundAuthTokenReviewAudiences = parseEnvList("INBOUND_AUTH_TOKEN_REVIEW_AUDIENCES", c.InboundAuthTokenReviewAudiences)
+
+	// Prometheus configuration
+	c.PrometheusNamespace = getEnvOrDefault("PROMETHEUS_NAMESPACE", c.PrometheusNamespace)
+	c.PrometheusService = getEnvOrDefault("PROMETHEUS_SERVICE", c.PrometheusService)
+	c.PrometheusPort = getEnvOrDefault("PROMETHEUS_PORT", c.PrometheusPort)
+	c.PrometheusAccess.Profile = getEnvOrDefault("PROMETHEUS_ACCESS_PROFILE", c.PrometheusAccess.Profile)
+	c.PrometheusReadiness = getEnvOrDefault("PROMETHEUS_READINESS", c.PrometheusReadiness)
+
+	c.FederateClusterLabels = parseEnvBool("FEDERATE_CLUSTER_LABELS", c.FederateClusterLabels)
+
+	// Loki configuration
+	c.LokiNamespace = getEnvOrDefault("LOKI_NAMESPACE", c.LokiNamespace)
+	c.LokiService = getEnvOrDefault("LOKI_SERVICE", c.LokiService)
+	c.LokiPort = getEnvOrDefault("LOKI_PORT", c.LokiPort)
+	c.LokiAccess.Profile = getEnvOrDefault("LOKI_ACCESS_PROFILE", c.LokiAccess.Profile)
+	c.LokiReadiness = getEnvOrDefault("LOKI_READINESS", c.LokiReadiness)
+	c.LokiOrgID = getEnvOrDefault("LOKI_ORG_ID", c.LokiOrgID)
+
+	// Generic remote endpoint configuration
+	c.RemoteNamespace = getEnvOrDefault("REMOTE_NAMESPACE", c.RemoteNamespace)
+	c.RemoteService = getEnvOrDefault("REMOTE_SERVICE", c.RemoteService)
+	c.RemotePort = getEnvOrDefault("REMOTE_PORT", c.RemotePort)
+	c.RemoteAccess.Profile = getEnvOrDefault("REMOTE_ACCESS_PROFILE", c.RemoteAccess.Profile)
+	c.RemoteReadiness = getEnvOrDefault("REMOTE_READINESS", c.RemoteReadiness)
+
+	return problems
+}
+
+// ClusterTargets returns the clusters this relay serves. When CLUSTERS is not
+// set the single CLUSTER_ID/CLUSTER_NAME pair is used.
+func (c Config) ClusterTargets() []ClusterTarget {
+	if len(c.Clusters) > 0 {
+		return c.Clusters
+	}
+	if c.ClusterId == "" {
+		return nil
 	}
+	return []ClusterTarget{{ID: c.ClusterId, Name: c.ClusterName}}
+}
 
-	CFG = config
+// parseClusterTargets parses a comma separated list of "id" or "id=name" entries
+func parseClusterTargets(value string) []ClusterTarget {
+	var targets []ClusterTarget
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, name, _ := strings.Cut(entry, "=")
+		targets = append(targets, ClusterTarget{
+			ID:   strings.TrimSpace(id),
+			Name: strings.TrimSpace(name),
+		})
+	}
+	return targets
+}
 
-	return config
+func parseEnvClusters(key string, defaultValue []ClusterTarget) []ClusterTarget {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return parseClusterTargets(value)
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -72,11 +358,50 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
-func parseEnvBool(key string) bool {
+func parseEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value == "true"
+}
+
+func parseEnvInt(key string, defaultValue int, problems *[]string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %q is not a whole number", key, value))
+		return defaultValue
+	}
+	return intValue
+}
+
+func parseEnvDuration(key string, defaultValue time.Duration, problems *[]string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %q is not a duration such as 30s or 5m", key, value))
+		return defaultValue
+	}
+	return duration
+}
+
+func parseEnvList(key string, defaultValue []string) []string {
 	value := os.Getenv(key)
-	boolValue := false
-	if value == "true" {
-		boolValue = true
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
-	return boolValue
+	return list
 }
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadReportsMalformedEnvironment(t *testing.T) {
+	t.Setenv("RANCHER_API_ENDPOINT", "https://rancher.example.com")
+	t.Setenv("RANCHER_API_TOKEN", "token")
+	t.Setenv("CLUSTER_ID", "c-1")
+	t.Setenv("HEALTH_PROBE_INTERVAL", "5x")
+	t.Setenv("HEALTH_FAILURE_THRESHOLD", "three")
+	t.Setenv("DISCOVERY_LABEL_SELECTOR", "env=prod,=dev")
+
+	_, err := Read("")
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Read returned %v, want a *ValidationError", err)
+	}
+
+	for _, want := range []string{
+		`HEALTH_PROBE_INTERVAL "5x" is not a duration`,
+		`HEALTH_FAILURE_THRESHOLD "three" is not a whole number`,
+		`discovery.labelSelector (DISCOVERY_LABEL_SELECTOR) is not a valid label selector`,
+	} {
+		found := false
+		for _, problem := range validationErr.Problems {
+			if strings.Contains(problem, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("problems %q do not mention %q", validationErr.Problems, want)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	defer func(cfg Config) { CFG = cfg; Set(cfg) }(CFG)
+	t.Setenv("RANCHER_API_ENDPOINT", "https://rancher.example.com")
+	t.Setenv("CLUSTER_ID", "c-1")
+	t.Setenv("LOKI_PORT", "3200")
+
+	// Invalid settings are still loaded, as before validation existed
+	t.Setenv("HEALTH_FAILURE_THRESHOLD", "0")
+
+	cfg := LoadConfigFromEnv()
+	if cfg.RancherApiEndpoint != "https://rancher.example.com" || cfg.ClusterId != "c-1" || cfg.LokiPort != "3200" {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+	if cfg.PrometheusNamespace != Defaults().PrometheusNamespace {
+		t.Errorf("PrometheusNamespace = %q, want the default", cfg.PrometheusNamespace)
+	}
+	if CFG.LokiPort != "3200" || Current().LokiPort != "3200" {
+		t.Error("configuration was not stored")
+	}
+}
+
+func TestValidateTenantClients(t *testing.T) {
+	cfg := Config{InboundAuthTokens: []string{"secret"}}
+	tenants := []Tenant{{Name: "team-a", Clients: []string{"*", "basic:grafana", "token:token-1", "cert:prometheus", "sa:system:serviceaccount:team-a:prometheus", "grafana", "oidc:grafana", "token:"}}}
+
+	problems := cfg.validateTenants("services.prometheus.tenants", tenants, false)
+	want := []string{
+		`services.prometheus.tenants[0] (team-a) client "grafana" must be "*" or start with basic:, token:, cert: or sa:`,
+		`services.prometheus.tenants[0] (team-a) client "oidc:grafana" must be "*" or start with basic:, token:, cert: or sa:`,
+		`services.prometheus.tenants[0] (team-a) client "token:" must be "*" or start with basic:, token:, cert: or sa:`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems = %q, want %q", problems, want)
+	}
+}
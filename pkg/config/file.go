@@ -0,0 +1,552 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileVersion is the config file schema version understood by this build
+const FileVersion = 1
+
+// File is the config file schema. Every field is optional; unset fields keep
+// their default and any environment variable that is set overrides the file.
+// JSON files are accepted as well since JSON is valid YAML.
+type File struct {
+	Version int   `yaml:"version"`
+	Debug   *bool `yaml:"debug"`
+
+	// How often the file is checked for changes
+	ReloadInterval *Duration `yaml:"reloadInterval"`
+
+	Rancher   *RancherFile     `yaml:"rancher"`
+	Clusters  []ClusterFile    `yaml:"clusters"`
+	Routing   *string          `yaml:"routing"`
+	Discovery *DiscoveryFile   `yaml:"discovery"`
+	Services  *ServicesFile    `yaml:"services"`
+	Upstreams []UpstreamFile   `yaml:"upstreams"`
+	Auth      *InboundAuthFile `yaml:"inboundAuth"`
+	Listeners *ListenersFile   `yaml:"listeners"`
+	Health    *HealthFile      `yaml:"health"`
+}
+
+// RancherFile configures the connection to Rancher
+type RancherFile struct {
+	Endpoint           *string   `yaml:"endpoint"`
+	InsecureSkipVerify *bool     `yaml:"insecureSkipVerify"`
+	DirectClusterAPI   *bool     `yaml:"directClusterAPI"`
+	Auth               *AuthFile `yaml:"auth"`
+	TLS                *TLSFile  `yaml:"tls"`
+	Pool               *PoolFile `yaml:"pool"`
+}
+
+// AuthFile configures the credentials used for Rancher
+type AuthFile struct {
+	Type              *string   `yaml:"type"`
+	AccessKey         *string   `yaml:"accessKey"`
+	AccessKeyFile     *string   `yaml:"accessKeyFile"`
+	SecretKey         *string   `yaml:"secretKey"`
+	SecretKeyFile     *string   `yaml:"secretKeyFile"`
+	Token             *string   `yaml:"token"`
+	TokenFile         *string   `yaml:"tokenFile"`
+	Kubeconfig        *string   `yaml:"kubeconfig"`
+	KubeconfigContext *string   `yaml:"kubeconfigContext"`
+	ReloadInterval    *Duration `yaml:"reloadInterval"`
+}
+
+// TLSFile configures TLS for Rancher connections
+type TLSFile struct {
+	CAFile         *string `yaml:"caFile"`
+	CAPEM          *string `yaml:"caPEM"`
+	ClientCertFile *string `yaml:"clientCertFile"`
+	ClientKeyFile  *string `yaml:"clientKeyFile"`
+	MinVersion     *string `yaml:"minVersion"`
+	ServerName     *string `yaml:"serverName"`
+}
+
+// PoolFile configures the upstream connection pools
+type PoolFile struct {
+	MaxIdleConns        *int      `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost *int      `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     *int      `yaml:"maxConnsPerHost"`
+	IdleConnTimeout     *Duration `yaml:"idleConnTimeout"`
+	HTTP2               *bool     `yaml:"http2"`
+	DialTimeout         *Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout *Duration `yaml:"tlsHandshakeTimeout"`
+}
+
+// ClusterFile is a statically configured cluster
+type ClusterFile struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+}
+
+// DiscoveryFile configures cluster discovery
+type DiscoveryFile struct {
+	Enabled       *bool     `yaml:"enabled"`
+	Interval      *Duration `yaml:"interval"`
+	LabelSelector *string   `yaml:"labelSelector"`
+	NameRegex     *string   `yaml:"nameRegex"`
+	States        []string  `yaml:"states"`
+	IncludeLocal  *bool     `yaml:"includeLocal"`
+}
+
+// ServicesFile configures the relayed services
+type ServicesFile struct {
+	Prometheus *ServiceFile `yaml:"prometheus"`
+	Loki       *ServiceFile `yaml:"loki"`
+	Remote     *ServiceFile `yaml:"remote"`
+}
+
+// ServiceFile locates a service inside every relayed cluster
+type ServiceFile struct {
+	Namespace *string `yaml:"namespace"`
+	Service   *string `yaml:"service"`
+	Port      *string `yaml:"port"`
+
+	Access    *AccessFile `yaml:"access"`
+	Readiness *string     `yaml:"readiness"`
+
+	// Prometheus and Loki
+	Tenants []TenantFile `yaml:"tenants"`
+
+	// Prometheus only
+	FederateClusterLabels *bool `yaml:"federateClusterLabels"`
+
+	// Loki only
+	OrgID *string `yaml:"orgID"`
+}
+
+// TenantFile restricts a set of clients to the data its matchers select
+type TenantFile struct {
+	Name     string   `yaml:"name"`
+	Clients  []string `yaml:"clients"`
+	Matchers []string `yaml:"matchers"`
+	OrgID    string   `yaml:"orgID"`
+}
+
+// ListenerTLSFile configures HTTPS on the relay's listeners
+type ListenerTLSFile struct {
+	CertFile   *string `yaml:"certFile"`
+	KeyFile    *string `yaml:"keyFile"`
+	MinVersion *string `yaml:"minVersion"`
+}
+
+// InboundAuthFile configures how clients of the relay authenticate
+type InboundAuthFile struct {
+	Tokens               []string `yaml:"tokens"`
+	TokensFile           *string  `yaml:"tokensFile"`
+	HtpasswdFile         *string  `yaml:"htpasswdFile"`
+	ClientCAFile         *string  `yaml:"clientCAFile"`
+	TokenReview          *bool    `yaml:"tokenReview"`
+	TokenReviewAudiences []string `yaml:"tokenReviewAudiences"`
+}
+
+// UpstreamFile declares an additional named upstream
+type UpstreamFile struct {
+	Name       string `yaml:"name"`
+	Namespace  string `yaml:"namespace"`
+	Service    string `yaml:"service"`
+	Port       string `yaml:"port"`
+	Scheme     string `yaml:"scheme"`
+	HealthPath string `yaml:"healthPath"`
+	ListenPort string `yaml:"listenPort"`
+	PathPrefix string `yaml:"pathPrefix"`
+	Readiness  string `yaml:"readiness"`
+
+	Access *AccessFile `yaml:"access"`
+}
+
+// AccessFile restricts the requests relayed to a service
+type AccessFile struct {
+	Profile string           `yaml:"profile"`
+	Allow   []AccessRuleFile `yaml:"allow"`
+	Deny    []AccessRuleFile `yaml:"deny"`
+}
+
+// AccessRuleFile matches requests by method and path pattern
+type AccessRuleFile struct {
+	Methods []string `yaml:"methods"`
+	Path    string   `yaml:"path"`
+}
+
+// policy converts the access block of a service
+func (a *AccessFile) policy() AccessPolicy {
+	policy := AccessPolicy{Profile: a.Profile}
+	for _, rule := range a.Allow {
+		policy.Allow = append(policy.Allow, AccessRule(rule))
+	}
+	for _, rule := range a.Deny {
+		policy.Deny = append(policy.Deny, AccessRule(rule))
+	}
+	return policy
+}
+
+// ListenersFile configures the servers of the relay
+type ListenersFile struct {
+	Address         *string          `yaml:"address"`
+	MetricsPort     *string          `yaml:"metricsPort"`
+	PrometheusPort  *string          `yaml:"prometheusPort"`
+	LokiPort        *string          `yaml:"lokiPort"`
+	SDTargetHost    *string          `yaml:"sdTargetHost"`
+	SDFederateMatch *string          `yaml:"sdFederateMatch"`
+	SinglePort      *bool            `yaml:"singlePort"`
+	TLS             *ListenerTLSFile `yaml:"tls"`
+	Shutdown        *ShutdownFile    `yaml:"shutdown"`
+}
+
+// ShutdownFile configures how the listeners drain on SIGTERM
+type ShutdownFile struct {
+	DrainDelay *Duration `yaml:"drainDelay"`
+	Timeout    *Duration `yaml:"timeout"`
+}
+
+// HealthFile configures the background health checks
+type HealthFile struct {
+	Interval         *Duration `yaml:"interval"`
+	Timeout          *Duration `yaml:"timeout"`
+	FailureThreshold *int      `yaml:"failureThreshold"`
+	SuccessThreshold *int      `yaml:"successThreshold"`
+	ReadyMinClusters *int      `yaml:"readyMinClusters"`
+}
+
+// Duration is a time.Duration written as a Go duration string such as "30s"
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		// A TypeError lets the decoder report it and carry on with the other fields
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: invalid duration %q", value.Line, value.Value)}}
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Load builds the configuration from the defaults, the config file at path (if
+// any) and the environment, validates it and stores it in CFG. All problems
+// found are returned together as a *ValidationError.
+func Load(path string) (Config, error) {
+	config, err := Read(path)
+	if err != nil {
+		return config, err
+	}
+
+	CFG = config
+	Set(config)
+	return config, nil
+}
+
+// LoadConfigFromEnv loads the defaults overridden by environment variables into
+// CFG and returns them.
+//
+// Deprecated: Use Load, which also reads a config file and reports invalid
+// settings. LoadConfigFromEnv stores the configuration even when it does not
+// validate, as it did before validation was added.
+func LoadConfigFromEnv() Config {
+	config, err := Load("")
+	if err != nil {
+		CFG = config
+		Set(config)
+	}
+	return config
+}
+
+// Read builds and validates the configuration like Load without publishing it
+func Read(path string) (Config, error) {
+	config := Defaults()
+	var problems []string
+	if path != "" {
+		file, err := ReadFile(path)
+		if validationErr, ok := err.(*ValidationError); ok {
+			problems = append(problems, validationErr.Problems...)
+		} else if err != nil {
+			return config, err
+		}
+		// Apply whatever could be parsed so the remaining problems are reported too
+		if file != nil {
+			file.Apply(&config)
+		}
+	}
+	problems = append(problems, applyEnv(&config)...)
+
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	if len(problems) > 0 {
+		return config, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+// ReadFile reads and parses the config file at path, interpolating environment
+// variables in every value
+func ReadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	return ParseFile(data)
+}
+
+// ParseFile parses a config file. Values may reference environment variables as
+// ${VAR} or ${VAR:-default}; "$$" is a literal "$". Unknown fields, invalid values
+// and undefined variables are returned together as a *ValidationError, along
+// with the settings that could be parsed.
+func ParseFile(data []byte) (*File, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &ValidationError{Problems: []string{fmt.Sprintf("invalid config file: %v", err)}}
+	}
+
+	var problems []string
+	interpolateNode(&root, &problems)
+
+	// Re-encode the interpolated document so it can be decoded strictly
+	interpolated, err := yaml.Marshal(&root)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding config file: %v", err)
+	}
+	var file File
+	decoder := yaml.NewDecoder(bytes.NewReader(interpolated))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			problems = append(problems, typeErr.Errors...)
+		} else {
+			return nil, &ValidationError{Problems: append(problems, err.Error())}
+		}
+	}
+
+	if file.Version != FileVersion {
+		problems = append(problems, fmt.Sprintf("unsupported config file version %d, expected version: %d", file.Version, FileVersion))
+	}
+	if len(problems) > 0 {
+		return &file, &ValidationError{Problems: problems}
+	}
+	return &file, nil
+}
+
+// envReference matches $$, ${VAR} and ${VAR:-default}
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateNode replaces environment variable references in every scalar under node
+func interpolateNode(node *yaml.Node, problems *[]string) {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "$") {
+		value := envReference.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if ref == "$$" {
+				return "$"
+			}
+			match := envReference.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(match[1]); ok && value != "" {
+				return value
+			}
+			if match[2] != "" {
+				return match[3]
+			}
+			if _, ok := os.LookupEnv(match[1]); ok {
+				return ""
+			}
+			*problems = append(*problems, fmt.Sprintf("line %d: environment variable %s is not set", node.Line, match[1]))
+			return ""
+		})
+		if value != node.Value {
+			node.Value = value
+			// Let the interpolated value resolve to a number or bool like a literal would
+			node.Tag = ""
+			node.Style = 0
+		}
+	}
+	for _, child := range node.Content {
+		interpolateNode(child, problems)
+	}
+}
+
+// Apply copies every setting present in the file into c
+func (f *File) Apply(c *Config) {
+	set(&c.Debug, f.Debug)
+	setDuration(&c.ConfigReloadInterval, f.ReloadInterval)
+	set(&c.ClusterRouting, f.Routing)
+
+	if r := f.Rancher; r != nil {
+		set(&c.RancherApiEndpoint, r.Endpoint)
+		set(&c.RancherInsecureSkipVerify, r.InsecureSkipVerify)
+		set(&c.DirectClusterAPI, r.DirectClusterAPI)
+
+		if a := r.Auth; a != nil {
+			set(&c.RancherAuthType, a.Type)
+			set(&c.RancherApiAccessKey, a.AccessKey)
+			set(&c.RancherApiAccessKeyFile, a.AccessKeyFile)
+			set(&c.RancherApiSecretKey, a.SecretKey)
+			set(&c.RancherApiSecretKeyFile, a.SecretKeyFile)
+			set(&c.RancherApiToken, a.Token)
+			set(&c.RancherApiTokenFile, a.TokenFile)
+			set(&c.RancherKubeconfig, a.Kubeconfig)
+			set(&c.RancherKubeconfigContext, a.KubeconfigContext)
+			setDuration(&c.CredentialsReloadInterval, a.ReloadInterval)
+		}
+		if t := r.TLS; t != nil {
+			set(&c.RancherCAFile, t.CAFile)
+			set(&c.RancherCAPEM, t.CAPEM)
+			set(&c.RancherClientCertFile, t.ClientCertFile)
+			set(&c.RancherClientKeyFile, t.ClientKeyFile)
+			set(&c.RancherTLSMinVersion, t.MinVersion)
+			set(&c.RancherTLSServerName, t.ServerName)
+		}
+		if p := r.Pool; p != nil {
+			set(&c.UpstreamMaxIdleConns, p.MaxIdleConns)
+			set(&c.UpstreamMaxIdleConnsPerHost, p.MaxIdleConnsPerHost)
+			set(&c.UpstreamMaxConnsPerHost, p.MaxConnsPerHost)
+			setDuration(&c.UpstreamIdleConnTimeout, p.IdleConnTimeout)
+			set(&c.UpstreamHTTP2, p.HTTP2)
+			setDuration(&c.UpstreamDialTimeout, p.DialTimeout)
+			setDuration(&c.UpstreamTLSHandshakeTimeout, p.TLSHandshakeTimeout)
+		}
+	}
+
+	if f.Clusters != nil {
+		c.Clusters = nil
+		for _, cl := range f.Clusters {
+			c.Clusters = append(c.Clusters, ClusterTarget{ID: cl.ID, Name: cl.Name})
+		}
+	}
+
+	if d := f.Discovery; d != nil {
+		set(&c.DiscoveryEnabled, d.Enabled)
+		setDuration(&c.DiscoveryInterval, d.Interval)
+		set(&c.DiscoveryLabelSelector, d.LabelSelector)
+		set(&c.DiscoveryNameRegex, d.NameRegex)
+		if d.States != nil {
+			c.DiscoveryStates = d.States
+		}
+		set(&c.DiscoveryIncludeLocal, d.IncludeLocal)
+	}
+
+	if s := f.Services; s != nil {
+		if p := s.Prometheus; p != nil {
+			set(&c.PrometheusNamespace, p.Namespace)
+			set(&c.PrometheusService, p.Service)
+			set(&c.PrometheusPort, p.Port)
+			set(&c.FederateClusterLabels, p.FederateClusterLabels)
+			if p.Access != nil {
+				c.PrometheusAccess = p.Access.policy()
+			}
+			set(&c.PrometheusReadiness, p.Readiness)
+			if p.Tenants != nil {
+				c.PrometheusTenants = tenants(p.Tenants)
+			}
+		}
+		if l := s.Loki; l != nil {
+			set(&c.LokiNamespace, l.Namespace)
+			set(&c.LokiService, l.Service)
+			set(&c.LokiPort, l.Port)
+			if l.Access != nil {
+				c.LokiAccess = l.Access.policy()
+			}
+			set(&c.LokiReadiness, l.Readiness)
+			set(&c.LokiOrgID, l.OrgID)
+			if l.Tenants != nil {
+				c.LokiTenants = tenants(l.Tenants)
+			}
+		}
+		if r := s.Remote; r != nil {
+			set(&c.RemoteNamespace, r.Namespace)
+			set(&c.RemoteService, r.Service)
+			set(&c.RemotePort, r.Port)
+			if r.Access != nil {
+				c.RemoteAccess = r.Access.policy()
+			}
+			set(&c.RemoteReadiness, r.Readiness)
+		}
+	}
+
+	if f.Upstreams != nil {
+		c.CustomUpstreams = nil
+		for _, u := range f.Upstreams {
+			upstream := Upstream{
+				Name:       u.Name,
+				Namespace:  u.Namespace,
+				Service:    u.Service,
+				Port:       u.Port,
+				Scheme:     u.Scheme,
+				HealthPath: u.HealthPath,
+				ListenPort: u.ListenPort,
+				PathPrefix: u.PathPrefix,
+				Readiness:  u.Readiness,
+			}
+			if u.Access != nil {
+				upstream.Access = u.Access.policy()
+			}
+			c.CustomUpstreams = append(c.CustomUpstreams, upstream)
+		}
+	}
+
+	if a := f.Auth; a != nil {
+		if a.Tokens != nil {
+			c.InboundAuthTokens = a.Tokens
+		}
+		set(&c.InboundAuthTokensFile, a.TokensFile)
+		set(&c.InboundAuthHtpasswdFile, a.HtpasswdFile)
+		set(&c.InboundAuthClientCAFile, a.ClientCAFile)
+		set(&c.InboundAuthTokenReview, a.TokenReview)
+		if a.TokenReviewAudiences != nil {
+			c.InboundAuthTokenReviewAudiences = a.TokenReviewAudiences
+		}
+	}
+
+	if l := f.Listeners; l != nil {
+		set(&c.ListenAddress, l.Address)
+		set(&c.MetricsPort, l.MetricsPort)
+		set(&c.PrometheusListenPort, l.PrometheusPort)
+		set(&c.LokiListenPort, l.LokiPort)
+		set(&c.SDTargetHost, l.SDTargetHost)
+		set(&c.SDFederateMatch, l.SDFederateMatch)
+		set(&c.SinglePort, l.SinglePort)
+		if t := l.TLS; t != nil {
+			set(&c.ListenerTLSCertFile, t.CertFile)
+			set(&c.ListenerTLSKeyFile, t.KeyFile)
+			set(&c.ListenerTLSMinVersion, t.MinVersion)
+		}
+		if s := l.Shutdown; s != nil {
+			setDuration(&c.ShutdownDrainDelay, s.DrainDelay)
+			setDuration(&c.ShutdownTimeout, s.Timeout)
+		}
+	}
+
+	if h := f.Health; h != nil {
+		setDuration(&c.HealthProbeInterval, h.Interval)
+		setDuration(&c.HealthProbeTimeout, h.Timeout)
+		set(&c.HealthFailureThreshold, h.FailureThreshold)
+		set(&c.HealthSuccessThreshold, h.SuccessThreshold)
+		set(&c.ReadyMinClusters, h.ReadyMinClusters)
+	}
+}
+
+// tenants converts the tenants of a service
+func tenants(files []TenantFile) []Tenant {
+	tenants := make([]Tenant, 0, len(files))
+	for _, t := range files {
+		tenants = append(tenants, Tenant(t))
+	}
+	return tenants
+}
+
+// set copies *src into dst when the file sets it
+func set[T any](dst *T, src *T) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// setDuration copies *src into dst when the file sets it
+func setDuration(dst *time.Duration, src *Duration) {
+	if src != nil {
+		*dst = time.Duration(*src)
+	}
+}
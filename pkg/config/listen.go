@@ -0,0 +1,45 @@
+package config
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listener setting as a Unix socket path
+const unixPrefix = "unix:"
+
+// Listen resolves a listener setting to the network and address passed to
+// net.Listen. value is a port, a host:port pair or unix:/path/to/socket; a
+// bare port binds ListenAddress.
+func (c Config) Listen(value string) (network, address string) {
+	if path, ok := strings.CutPrefix(value, unixPrefix); ok {
+		return "unix", path
+	}
+	if _, err := strconv.Atoi(value); err == nil {
+		return "tcp", net.JoinHostPort(c.ListenAddress, value)
+	}
+	return "tcp", value
+}
+
+// ListenPort returns the TCP port of a listener setting, or "" for a Unix socket
+func ListenPort(value string) string {
+	if strings.HasPrefix(value, unixPrefix) {
+		return ""
+	}
+	if _, port, err := net.SplitHostPort(value); err == nil {
+		return port
+	}
+	return value
+}
+
+// validListen reports whether value is a valid listener setting
+func validListen(value string) bool {
+	if path, ok := strings.CutPrefix(value, unixPrefix); ok {
+		return strings.HasPrefix(path, "/")
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		return validPort(port) && !strings.Contains(host, "/")
+	}
+	return validPort(value)
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelRequirement is a single key=value, key!=value or key term of a label selector
+type labelRequirement struct {
+	key      string
+	value    string
+	operator string
+}
+
+// LabelSelector is a conjunction of label requirements
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a comma separated selector such as "env=prod,tier!=dev,monitored"
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var requirements LabelSelector
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			key, value, _ := strings.Cut(term, "!=")
+			req = labelRequirement{key: strings.TrimSpace(key), value: strings.TrimSpace(value), operator: "!="}
+		case strings.Contains(term, "="):
+			key, value, _ := strings.Cut(strings.Replace(term, "==", "=", 1), "=")
+			req = labelRequirement{key: strings.TrimSpace(key), value: strings.TrimSpace(value), operator: "="}
+		default:
+			req = labelRequirement{key: term, operator: "exists"}
+		}
+
+		if req.key == "" {
+			return nil, fmt.Errorf("empty label key in %q", term)
+		}
+		requirements = append(requirements, req)
+	}
+	return requirements, nil
+}
+
+// Matches reports whether labels satisfy every requirement of the selector
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch req.operator {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		}
+	}
+	return true
+}
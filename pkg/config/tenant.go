@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Tenant limits the clients it lists to the series or log streams selected by
+// its label matchers. A tenant without matchers is unrestricted.
+type Tenant struct {
+	Name string
+
+	// Clients are identity names from inbound authentication, prefixed with
+	// the method, e.g. basic:grafana; "*" is any authenticated client
+	Clients []string
+
+	// Matchers are label matchers such as namespace=~"team-a-.*" added to every
+	// selector of the tenant's queries
+	Matchers []string
+
+	// OrgID is the X-Scope-OrgID sent to Loki for the tenant's requests. It may
+	// contain {cluster_id} and {cluster_name}. Loki only.
+	OrgID string
+}
+
+// LabelMatchers parses the tenant's matchers
+func (t Tenant) LabelMatchers() ([]*labels.Matcher, error) {
+	var matchers []*labels.Matcher
+	for _, m := range t.Matchers {
+		parsed, err := parser.ParseMetricSelector("{" + m + "}")
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher %q: %v", m, err)
+		}
+		matchers = append(matchers, parsed...)
+	}
+	return matchers, nil
+}
+
+// clientMethods are the prefixes of the client names assigned by inbound
+// authentication: htpasswd users, tokens, client certificates and TokenReview
+var clientMethods = []string{"basic", "token", "cert", "sa"}
+
+// validClient reports whether a tenant client is "*" or a method-prefixed name
+func validClient(client string) bool {
+	method, name, ok := strings.Cut(client, ":")
+	if client == "*" {
+		return true
+	}
+	if !ok || name == "" {
+		return false
+	}
+	for _, m := range clientMethods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundAuthEnabled reports whether clients of the relay authenticate
+func (c Config) inboundAuthEnabled() bool {
+	return len(c.InboundAuthTokens) > 0 || c.InboundAuthTokensFile != "" || c.InboundAuthHtpasswdFile != "" ||
+		c.InboundAuthClientCAFile != "" || c.InboundAuthTokenReview
+}
+
+// validateTenants returns the problems of a service's tenant list. orgIDs tells
+// whether the service accepts an X-Scope-OrgID per tenant.
+func (c Config) validateTenants(field string, tenants []Tenant, orgIDs bool) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(tenants) > 0 && !c.inboundAuthEnabled() {
+		addf("%s requires inbound authentication to identify clients", field)
+	}
+	names := make(map[string]bool)
+	for i, t := range tenants {
+		name := fmt.Sprintf("%s[%d]", field, i)
+		if t.Name == "" {
+			addf("%s has no name", name)
+		} else if names[t.Name] {
+			addf("%s duplicates tenant %q", name, t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Clients) == 0 {
+			addf("%s (%s) lists no clients", name, t.Name)
+		}
+		for _, client := range t.Clients {
+			if !validClient(client) {
+				addf("%s (%s) client %q must be \"*\" or start with basic:, token:, cert: or sa:", name, t.Name, client)
+			}
+		}
+		if _, err := t.LabelMatchers(); err != nil {
+			addf("%s (%s) has an %v", name, t.Name, err)
+		}
+		if t.OrgID != "" && !orgIDs {
+			addf("%s (%s) orgID only applies to Loki tenants", name, t.Name)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,122 @@
+package config
+
+// Names of the built-in upstreams
+const (
+	PrometheusUpstream = "prometheus"
+	LokiUpstream       = "loki"
+)
+
+// Upstream is a named service relayed from every cluster
+type Upstream struct {
+	Name      string
+	Namespace string
+	Service   string
+	Port      string
+
+	// Scheme is "http" (default) or "https". HTTPS services are addressed as
+	// "https:{service}:{port}" through the Kubernetes service proxy.
+	Scheme string
+
+	// HealthPath is requested by the readiness check, relative to the service root
+	HealthPath string
+
+	// ListenPort serves the upstream on a listener of its own
+	ListenPort string
+	// PathPrefix serves the upstream under this path on the metrics port
+	PathPrefix string
+
+	// Access restricts the methods and paths clients may request
+	Access AccessPolicy
+
+	// Readiness decides how the upstream counts for /ready: critical (default),
+	// optional or ignored
+	Readiness string
+}
+
+// Readiness policies of an upstream
+const (
+	// ReadinessCritical upstreams fail /ready when they are unhealthy in any cluster
+	ReadinessCritical = "critical"
+	// ReadinessOptional upstreams are reported by /ready but never fail it
+	ReadinessOptional = "optional"
+	// ReadinessIgnored upstreams are left out of /ready. They are still checked
+	// for /status and /ready/{service}.
+	ReadinessIgnored = "ignored"
+)
+
+// validReadiness lists the accepted readiness policies
+var validReadiness = []string{ReadinessCritical, ReadinessOptional, ReadinessIgnored}
+
+// ReadinessPolicy returns the readiness policy of the upstream
+func (u Upstream) ReadinessPolicy() string {
+	if u.Readiness == "" {
+		return ReadinessCritical
+	}
+	return u.Readiness
+}
+
+// RouterPath returns the path the upstream is served under in single-port
+// mode: /prometheus and /loki for the built-in upstreams, /svc/{name} otherwise
+func (u Upstream) RouterPath() string {
+	if u.Name == PrometheusUpstream || u.Name == LokiUpstream {
+		return "/" + u.Name
+	}
+	return "/svc/" + u.Name
+}
+
+// Upstreams returns every relayed service: Prometheus and Loki when their
+// namespace is set, the REMOTE_* service when configured, then the upstreams
+// declared in the config file
+func (c Config) Upstreams() []Upstream {
+	var upstreams []Upstream
+
+	if c.PrometheusNamespace != "" {
+		upstreams = append(upstreams, Upstream{
+			Name:       PrometheusUpstream,
+			Namespace:  c.PrometheusNamespace,
+			Service:    c.PrometheusService,
+			Port:       c.PrometheusPort,
+			HealthPath: "/-/ready",
+			ListenPort: c.PrometheusListenPort,
+			Access:     c.PrometheusAccess,
+			Readiness:  c.PrometheusReadiness,
+		})
+	}
+
+	if c.LokiNamespace != "" {
+		upstreams = append(upstreams, Upstream{
+			Name:       LokiUpstream,
+			Namespace:  c.LokiNamespace,
+			Service:    c.LokiService,
+			Port:       c.LokiPort,
+			HealthPath: "/ready",
+			ListenPort: c.LokiListenPort,
+			Access:     c.LokiAccess,
+			Readiness:  c.LokiReadiness,
+		})
+	}
+
+	if c.RemoteNamespace != "" && c.RemoteService != "" && c.RemotePort != "" {
+		upstreams = append(upstreams, Upstream{
+			Name:       c.RemoteService,
+			Namespace:  c.RemoteNamespace,
+			Service:    c.RemoteService,
+			Port:       c.RemotePort,
+			ListenPort: c.RemotePort,
+			Access:     c.RemoteAccess,
+			Readiness:  c.RemoteReadiness,
+		})
+	}
+
+	return append(upstreams, c.CustomUpstreams...)
+}
+
+// Upstream returns the relayed service with the given name
+func (c Config) Upstream(name string) (Upstream, bool) {
+	for _, u := range c.Upstreams() {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return Upstream{}, false
+}
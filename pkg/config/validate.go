@@ -0,0 +1,299 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+// Error renders the problems one per line
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// validTLSVersions are the accepted values of RANCHER_TLS_MIN_VERSION
+var validTLSVersions = []string{"1.0", "1.1", "1.2", "1.3"}
+
+// Validate checks the configuration as a whole and returns a *ValidationError
+// listing every problem, or nil
+func (c Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Rancher connection and credentials
+	authType := strings.ToLower(c.RancherAuthType)
+	switch authType {
+	case "", "basic", "bearer", "kubeconfig", "serviceaccount":
+	default:
+		addf("rancher.auth.type (RANCHER_AUTH_TYPE) %q must be one of basic, bearer, kubeconfig, serviceaccount", c.RancherAuthType)
+	}
+	if authType == "" {
+		switch {
+		case c.RancherApiToken != "" || c.RancherApiTokenFile != "":
+			authType = "bearer"
+		case c.RancherKubeconfig != "":
+			authType = "kubeconfig"
+		default:
+			authType = "basic"
+		}
+	}
+	switch authType {
+	case "basic":
+		if c.RancherApiAccessKey == "" && c.RancherApiAccessKeyFile == "" {
+			addf("rancher.auth.accessKey (RANCHER_API_ACCESS_KEY) or accessKeyFile is required for basic authentication")
+		}
+		if c.RancherApiSecretKey == "" && c.RancherApiSecretKeyFile == "" {
+			addf("rancher.auth.secretKey (RANCHER_API_SECRET_KEY) or secretKeyFile is required for basic authentication")
+		}
+	case "bearer":
+		if c.RancherApiToken == "" && c.RancherApiTokenFile == "" {
+			addf("rancher.auth.token (RANCHER_API_TOKEN) or tokenFile is required for bearer authentication")
+		}
+	case "kubeconfig":
+		if c.RancherKubeconfig == "" {
+			addf("rancher.auth.kubeconfig (RANCHER_KUBECONFIG) is required for kubeconfig authentication")
+		}
+	}
+	// Kubeconfig and ServiceAccount credentials supply their own endpoint
+	if c.RancherApiEndpoint == "" && authType != "kubeconfig" && authType != "serviceaccount" {
+		addf("rancher.endpoint (RANCHER_API_ENDPOINT) is required")
+	}
+	if c.ConfigReloadInterval < 0 {
+		addf("reloadInterval (CONFIG_RELOAD_INTERVAL) must not be negative")
+	}
+	if c.CredentialsReloadInterval < 0 {
+		addf("rancher.auth.reloadInterval (CREDENTIALS_RELOAD_INTERVAL) must not be negative")
+	}
+
+	// Rancher TLS
+	if !contains(validTLSVersions, c.RancherTLSMinVersion) {
+		addf("rancher.tls.minVersion (RANCHER_TLS_MIN_VERSION) %q must be one of %s", c.RancherTLSMinVersion, strings.Join(validTLSVersions, ", "))
+	}
+	if (c.RancherClientCertFile == "") != (c.RancherClientKeyFile == "") {
+		addf("rancher.tls.clientCertFile and clientKeyFile (RANCHER_CLIENT_CERT_FILE, RANCHER_CLIENT_KEY_FILE) must be set together")
+	}
+
+	// Upstream connection pool
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{
+		{"rancher.pool.maxIdleConns (UPSTREAM_MAX_IDLE_CONNS)", int64(c.UpstreamMaxIdleConns)},
+		{"rancher.pool.maxIdleConnsPerHost (UPSTREAM_MAX_IDLE_CONNS_PER_HOST)", int64(c.UpstreamMaxIdleConnsPerHost)},
+		{"rancher.pool.maxConnsPerHost (UPSTREAM_MAX_CONNS_PER_HOST)", int64(c.UpstreamMaxConnsPerHost)},
+		{"rancher.pool.idleConnTimeout (UPSTREAM_IDLE_CONN_TIMEOUT)", int64(c.UpstreamIdleConnTimeout)},
+		{"rancher.pool.dialTimeout (UPSTREAM_DIAL_TIMEOUT)", int64(c.UpstreamDialTimeout)},
+		{"rancher.pool.tlsHandshakeTimeout (UPSTREAM_TLS_HANDSHAKE_TIMEOUT)", int64(c.UpstreamTLSHandshakeTimeout)},
+	} {
+		if limit.value < 0 {
+			addf("%s must not be negative", limit.name)
+		}
+	}
+
+	// Clusters
+	if len(c.ClusterTargets()) == 0 && !c.DiscoveryEnabled {
+		addf("clusters (CLUSTER_ID or CLUSTERS) must list at least one cluster unless discovery is enabled")
+	}
+	seen := make(map[string]bool)
+	for i, target := range c.ClusterTargets() {
+		if target.ID == "" {
+			addf("clusters[%d] has no id", i)
+			continue
+		}
+		if seen[target.ID] {
+			addf("clusters[%d] duplicates cluster %q", i, target.ID)
+		}
+		seen[target.ID] = true
+	}
+	if c.ClusterRouting != "path" && c.ClusterRouting != "host" {
+		addf("routing (CLUSTER_ROUTING) %q must be path or host", c.ClusterRouting)
+	}
+
+	// Cluster discovery
+	if c.DiscoveryEnabled {
+		if c.DiscoveryInterval <= 0 {
+			addf("discovery.interval (DISCOVERY_INTERVAL) must be positive")
+		}
+		if c.DirectClusterAPI || authType == "serviceaccount" {
+			addf("discovery requires the Rancher API and cannot be used with directClusterAPI or serviceaccount authentication")
+		}
+	}
+	if _, err := ParseLabelSelector(c.DiscoveryLabelSelector); err != nil {
+		addf("discovery.labelSelector (DISCOVERY_LABEL_SELECTOR) is not a valid label selector: %v", err)
+	}
+	if c.DiscoveryNameRegex != "" {
+		if _, err := regexp.Compile(c.DiscoveryNameRegex); err != nil {
+			addf("discovery.nameRegex (DISCOVERY_NAME_REGEX) is not a valid regular expression: %v", err)
+		}
+	}
+
+	// Services and listeners
+	remote := []string{c.RemoteNamespace, c.RemoteService, c.RemotePort}
+	if strings.Join(remote, "") != "" && contains(remote, "") {
+		addf("services.remote namespace, service and port (REMOTE_NAMESPACE, REMOTE_SERVICE, REMOTE_PORT) must be set together")
+	}
+	for _, listener := range []struct {
+		name  string
+		value string
+	}{
+		{"listeners.metricsPort (METRICS_PORT)", c.MetricsPort},
+		{"listeners.prometheusPort (PROMETHEUS_LISTEN_PORT)", c.PrometheusListenPort},
+		{"listeners.lokiPort (LOKI_LISTEN_PORT)", c.LokiListenPort},
+	} {
+		if !validListen(listener.value) {
+			addf("%s %q must be a port, host:port or unix:/path/to/socket", listener.name, listener.value)
+		}
+	}
+	if (c.ListenerTLSCertFile == "") != (c.ListenerTLSKeyFile == "") {
+		addf("listeners.tls.certFile and keyFile (LISTEN_TLS_CERT_FILE, LISTEN_TLS_KEY_FILE) must be set together")
+	}
+	if !contains(validTLSVersions, c.ListenerTLSMinVersion) {
+		addf("listeners.tls.minVersion (LISTEN_TLS_MIN_VERSION) %q must be one of %s", c.ListenerTLSMinVersion, strings.Join(validTLSVersions, ", "))
+	}
+	if c.ShutdownDrainDelay < 0 {
+		addf("listeners.shutdown.drainDelay (SHUTDOWN_DRAIN_DELAY) must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		addf("listeners.shutdown.timeout (SHUTDOWN_TIMEOUT) must be positive")
+	}
+	if c.HealthProbeInterval <= 0 {
+		addf("health.interval (HEALTH_PROBE_INTERVAL) must be positive")
+	}
+	if c.HealthProbeTimeout <= 0 {
+		addf("health.timeout (HEALTH_PROBE_TIMEOUT) must be positive")
+	}
+	if c.HealthFailureThreshold < 1 {
+		addf("health.failureThreshold (HEALTH_FAILURE_THRESHOLD) must be at least 1")
+	}
+	if c.HealthSuccessThreshold < 1 {
+		addf("health.successThreshold (HEALTH_SUCCESS_THRESHOLD) must be at least 1")
+	}
+	if c.ReadyMinClusters < 1 {
+		addf("health.readyMinClusters (READY_MIN_CLUSTERS) must be at least 1")
+	}
+	if c.InboundAuthClientCAFile != "" && c.ListenerTLSCertFile == "" {
+		addf("inboundAuth.clientCAFile (INBOUND_AUTH_CLIENT_CA_FILE) requires listeners.tls.certFile (LISTEN_TLS_CERT_FILE)")
+	}
+	for i, token := range c.InboundAuthTokens {
+		if strings.TrimSpace(token) == "" {
+			addf("inboundAuth.tokens[%d] (INBOUND_AUTH_TOKENS) is empty", i)
+		}
+	}
+	for _, access := range []struct {
+		field, env string
+		policy     AccessPolicy
+	}{
+		{"services.prometheus.access", "PROMETHEUS_ACCESS_PROFILE", c.PrometheusAccess},
+		{"services.loki.access", "LOKI_ACCESS_PROFILE", c.LokiAccess},
+		{"services.remote.access", "REMOTE_ACCESS_PROFILE", c.RemoteAccess},
+	} {
+		problems = append(problems, validateAccess(access.field, access.env, access.policy)...)
+	}
+	for _, readiness := range []struct {
+		field, value string
+	}{
+		{"services.prometheus.readiness (PROMETHEUS_READINESS)", c.PrometheusReadiness},
+		{"services.loki.readiness (LOKI_READINESS)", c.LokiReadiness},
+		{"services.remote.readiness (REMOTE_READINESS)", c.RemoteReadiness},
+	} {
+		if readiness.value != "" && !contains(validReadiness, readiness.value) {
+			addf("%s %q must be one of %s", readiness.field, readiness.value, strings.Join(validReadiness, ", "))
+		}
+	}
+	problems = append(problems, c.validateTenants("services.prometheus.tenants", c.PrometheusTenants, false)...)
+	problems = append(problems, c.validateTenants("services.loki.tenants", c.LokiTenants, true)...)
+	names := make(map[string]bool)
+	ports := make(map[string]string)
+	network, address := c.Listen(c.MetricsPort)
+	ports[network+" "+address] = "the metrics listener"
+	prefixes := make(map[string]string)
+	for i, u := range c.CustomUpstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		if !upstreamName.MatchString(u.Name) {
+			addf("%s name %q must be lowercase letters, digits and dashes", field, u.Name)
+		}
+		if u.Namespace == "" || u.Service == "" || u.Port == "" {
+			addf("%s (%s) requires namespace, service and port", field, u.Name)
+		}
+		if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+			addf("%s (%s) scheme %q must be http or https", field, u.Name, u.Scheme)
+		}
+		if u.HealthPath != "" && !strings.HasPrefix(u.HealthPath, "/") {
+			addf("%s (%s) healthPath %q must start with /", field, u.Name, u.HealthPath)
+		}
+		if u.ListenPort == "" && u.PathPrefix == "" && !c.SinglePort {
+			addf("%s (%s) requires a listenPort or a pathPrefix", field, u.Name)
+		}
+		if u.ListenPort != "" && !validListen(u.ListenPort) {
+			addf("%s (%s) listenPort %q must be a port, host:port or unix:/path/to/socket", field, u.Name, u.ListenPort)
+		}
+		if u.Readiness != "" && !contains(validReadiness, u.Readiness) {
+			addf("%s (%s) readiness %q must be one of %s", field, u.Name, u.Readiness, strings.Join(validReadiness, ", "))
+		}
+		problems = append(problems, validateAccess(field+".access", "", u.Access)...)
+		if u.PathPrefix != "" {
+			prefix := strings.TrimSuffix(u.PathPrefix, "/")
+			switch {
+			case !strings.HasPrefix(prefix, "/"):
+				addf("%s (%s) pathPrefix %q must start with /", field, u.Name, u.PathPrefix)
+			case contains(reservedPathPrefixes, strings.SplitN(prefix[1:], "/", 2)[0]):
+				addf("%s (%s) pathPrefix %q conflicts with a built-in endpoint", field, u.Name, u.PathPrefix)
+			case prefixes[prefix] != "":
+				addf("%s (%s) pathPrefix %q is already used by %s", field, u.Name, u.PathPrefix, prefixes[prefix])
+			default:
+				prefixes[prefix] = u.Name
+			}
+		}
+	}
+	for _, u := range c.Upstreams() {
+		if names[u.Name] {
+			addf("upstream name %q is used more than once", u.Name)
+		}
+		names[u.Name] = true
+		// Single-port mode serves every upstream on the metrics listener
+		if u.ListenPort == "" || c.SinglePort {
+			continue
+		}
+		network, address := c.Listen(u.ListenPort)
+		if other, ok := ports[network+" "+address]; ok {
+			addf("upstream %q listens on %s, which is already used by %s", u.Name, u.ListenPort, other)
+			continue
+		}
+		ports[network+" "+address] = fmt.Sprintf("upstream %q", u.Name)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// upstreamName matches the names accepted for upstreams
+var upstreamName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// reservedPathPrefixes are first path segments served by the metrics listener itself
+var reservedPathPrefixes = []string{"", "health", "ready", "status", "version", "config", "metrics", "sd", "api", "prometheus", "loki", "svc"}
+
+// validPort reports whether port is a TCP port number
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// contains reports whether list contains value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
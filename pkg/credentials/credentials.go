@@ -0,0 +1,258 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// Supported values of RANCHER_AUTH_TYPE
+const (
+	AuthTypeBasic          = "basic"
+	AuthTypeBearer         = "bearer"
+	AuthTypeKubeconfig     = "kubeconfig"
+	AuthTypeServiceAccount = "serviceaccount"
+)
+
+// In-cluster ServiceAccount locations used by AuthTypeServiceAccount
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterEndpoint       = "https://kubernetes.default.svc"
+)
+
+// tokenFileRefresh is how long a token read from a file is cached before it is re-read
+const tokenFileRefresh = time.Minute
+
+// Credentials authenticate outgoing requests to Rancher or a Kubernetes API server
+type Credentials interface {
+	// Apply sets the Authorization header on req
+	Apply(req *http.Request)
+}
+
+// Source describes where outgoing requests go and how they are authenticated
+type Source struct {
+	Type        string
+	Credentials Credentials
+
+	// Endpoint overrides RANCHER_API_ENDPOINT when set, e.g. from a kubeconfig
+	Endpoint string
+	// Direct is true when Endpoint is a Kubernetes API server rather than Rancher
+	Direct bool
+
+	// TLS material supplied by a kubeconfig or the ServiceAccount mount
+	CAData            []byte
+	ClientCertificate *tls.Certificate
+
+	// Files the credentials were read from, watched for rotation
+	Files []string
+}
+
+var (
+	mu      sync.RWMutex
+	current = &Source{Type: AuthTypeBasic, Credentials: basicAuth{}}
+)
+
+// Current returns the credential source in use
+func Current() *Source {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// SetCurrent replaces the credential source in use
+func SetCurrent(source *Source) {
+	mu.Lock()
+	current = source
+	mu.Unlock()
+}
+
+// Load builds the credential source selected by cfg.RancherAuthType. When the
+// type is not set it is inferred from which credentials are configured.
+func Load(cfg config.Config) (*Source, error) {
+	switch authType(cfg) {
+	case AuthTypeBasic:
+		accessKey, err := valueOrFile(cfg.RancherApiAccessKey, cfg.RancherApiAccessKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading RANCHER_API_ACCESS_KEY_FILE: %v", err)
+		}
+		secretKey, err := valueOrFile(cfg.RancherApiSecretKey, cfg.RancherApiSecretKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading RANCHER_API_SECRET_KEY_FILE: %v", err)
+		}
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("RANCHER_API_ACCESS_KEY and RANCHER_API_SECRET_KEY (or their _FILE variants) must be set for basic authentication")
+		}
+		return &Source{
+			Type:        AuthTypeBasic,
+			Credentials: basicAuth{username: accessKey, password: secretKey},
+			Files:       nonEmpty(cfg.RancherApiAccessKeyFile, cfg.RancherApiSecretKeyFile),
+		}, nil
+
+	case AuthTypeBearer:
+		creds, err := bearerCredentials(cfg.RancherApiToken, cfg.RancherApiTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &Source{Type: AuthTypeBearer, Credentials: creds, Files: nonEmpty(cfg.RancherApiTokenFile)}, nil
+
+	case AuthTypeKubeconfig:
+		return loadKubeconfig(cfg.RancherKubeconfig, cfg.RancherKubeconfigContext)
+
+	case AuthTypeServiceAccount:
+		return InCluster()
+
+	default:
+		return nil, fmt.Errorf("unsupported RANCHER_AUTH_TYPE %q, expected basic, bearer, kubeconfig or serviceaccount", cfg.RancherAuthType)
+	}
+}
+
+// InCluster returns the credentials of the pod's ServiceAccount for the API
+// server of the cluster the relay runs in
+func InCluster() (*Source, error) {
+	token := &tokenFile{path: serviceAccountTokenFile}
+	if _, err := token.read(); err != nil {
+		return nil, fmt.Errorf("error reading ServiceAccount token: %v", err)
+	}
+	caData, err := os.ReadFile(serviceAccountCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ServiceAccount CA: %v", err)
+	}
+	return &Source{
+		Type:        AuthTypeServiceAccount,
+		Credentials: token,
+		Endpoint:    inClusterEndpoint,
+		Direct:      true,
+		CAData:      caData,
+		Files:       []string{serviceAccountTokenFile, serviceAccountCAFile},
+	}, nil
+}
+
+// authType returns the configured auth type or infers it from the credentials present
+func authType(cfg config.Config) string {
+	switch {
+	case cfg.RancherAuthType != "":
+		return strings.ToLower(cfg.RancherAuthType)
+	case cfg.RancherApiToken != "" || cfg.RancherApiTokenFile != "":
+		return AuthTypeBearer
+	case cfg.RancherKubeconfig != "":
+		return AuthTypeKubeconfig
+	default:
+		return AuthTypeBasic
+	}
+}
+
+// valueOrFile returns value, or the trimmed contents of path when value is empty
+func valueOrFile(value, path string) (string, error) {
+	if value != "" || path == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// nonEmpty returns the non-empty paths
+func nonEmpty(paths ...string) []string {
+	var files []string
+	for _, path := range paths {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// bearerCredentials returns a static token or one read from a file
+func bearerCredentials(token, tokenPath string) (Credentials, error) {
+	if token != "" {
+		return bearerToken{token: token}, nil
+	}
+	if tokenPath == "" {
+		return nil, fmt.Errorf("RANCHER_API_TOKEN or RANCHER_API_TOKEN_FILE must be set for bearer authentication")
+	}
+	creds := &tokenFile{path: tokenPath}
+	if _, err := creds.read(); err != nil {
+		return nil, fmt.Errorf("error reading RANCHER_API_TOKEN_FILE: %v", err)
+	}
+	return creds, nil
+}
+
+// basicAuth authenticates with a Rancher API access key and secret key
+type basicAuth struct {
+	username string
+	password string
+}
+
+// Apply sets HTTP Basic authentication
+func (b basicAuth) Apply(req *http.Request) {
+	req.SetBasicAuth(b.username, b.password)
+}
+
+// bearerToken authenticates with a static bearer token such as a Rancher "token-xxx:yyy" key
+type bearerToken struct {
+	token string
+}
+
+// Apply sets the bearer token
+func (b bearerToken) Apply(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+b.token)
+}
+
+// tokenFile authenticates with a bearer token read from a file that may be
+// rotated, such as a projected ServiceAccount token
+type tokenFile struct {
+	path string
+
+	mu       sync.Mutex
+	token    string
+	readTime time.Time
+}
+
+// Apply sets the bearer token, re-reading the file when the cached token is stale
+func (t *tokenFile) Apply(req *http.Request) {
+	token, err := t.read()
+	if err != nil {
+		// Keep using the last token that could be read
+		t.mu.Lock()
+		token = t.token
+		t.mu.Unlock()
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// read returns the token, re-reading the file at most once per tokenFileRefresh
+func (t *tokenFile) read() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Since(t.readTime) < tokenFileRefresh {
+		return t.token, nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", t.path)
+	}
+	t.token = token
+	t.readTime = time.Now()
+	return token, nil
+}
+
+// noCredentials leaves requests untouched, for client certificate authentication
+type noCredentials struct{}
+
+// Apply does nothing
+func (noCredentials) Apply(*http.Request) {}
@@ -0,0 +1,169 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rancherClusterPath is the path prefix of Rancher-generated kubeconfig servers
+const rancherClusterPath = "/k8s/clusters/"
+
+// kubeconfig is the subset of the kubeconfig file format used for authentication
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// loadKubeconfig builds a credential source from a kubeconfig file. Servers
+// generated by Rancher (https://rancher/k8s/clusters/c-xxx) are turned back
+// into the Rancher endpoint so the same token can reach every cluster; any
+// other server is used as a direct Kubernetes API endpoint.
+func loadKubeconfig(path, contextName string) (*Source, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading kubeconfig: %v", err)
+	}
+
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig %s: %v", path, err)
+	}
+
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == contextName {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", contextName, path)
+	}
+
+	source := &Source{Type: AuthTypeKubeconfig, Files: []string{path}}
+
+	found := false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		source.Endpoint, source.Direct, err = kubeconfigEndpoint(c.Cluster.Server)
+		if err != nil {
+			return nil, err
+		}
+		source.CAData, err = dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig certificate authority: %v", err)
+		}
+		source.Files = append(source.Files, nonEmpty(c.Cluster.CertificateAuthority)...)
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		user := u.User
+
+		switch {
+		case user.Token != "":
+			source.Credentials = bearerToken{token: user.Token}
+		case user.TokenFile != "":
+			source.Credentials, err = bearerCredentials("", user.TokenFile)
+		case user.Username != "":
+			source.Credentials = basicAuth{username: user.Username, password: user.Password}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		certPEM, err := dataOrFile(user.ClientCertificateData, user.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig client certificate: %v", err)
+		}
+		keyPEM, err := dataOrFile(user.ClientKeyData, user.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig client key: %v", err)
+		}
+		source.Files = append(source.Files, nonEmpty(user.TokenFile, user.ClientCertificate, user.ClientKey)...)
+		if len(certPEM) > 0 && len(keyPEM) > 0 {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("error loading kubeconfig client certificate: %v", err)
+			}
+			source.ClientCertificate = &cert
+		}
+	}
+
+	if source.Credentials == nil {
+		if source.ClientCertificate == nil {
+			return nil, fmt.Errorf("user %q in kubeconfig %s has no supported credentials", userName, path)
+		}
+		// Authentication happens with the client certificate during the TLS handshake
+		source.Credentials = noCredentials{}
+	}
+
+	return source, nil
+}
+
+// kubeconfigEndpoint returns the endpoint to use for a kubeconfig server URL
+func kubeconfigEndpoint(server string) (string, bool, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return "", false, fmt.Errorf("invalid kubeconfig server %q", server)
+	}
+	if i := strings.Index(u.Path, rancherClusterPath); i >= 0 {
+		u.Path = u.Path[:i]
+		return strings.TrimSuffix(u.String(), "/"), false, nil
+	}
+	return strings.TrimSuffix(server, "/"), true, nil
+}
+
+// dataOrFile returns base64 decoded inline data, or the contents of path
+func dataOrFile(data, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
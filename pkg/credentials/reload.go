@@ -0,0 +1,169 @@
+package credentials
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+)
+
+// unauthorizedRecheck limits how often a 401 from upstream re-reads the credential files
+const unauthorizedRecheck = 5 * time.Second
+
+var (
+	logger = logging.SetupLogging()
+
+	// watcher is the active watcher, used to re-read credentials on a 401
+	watcher atomic.Pointer[Watcher]
+
+	reloadHooksMu sync.Mutex
+	reloadHooks   []func(*Source)
+)
+
+// ReloadStats counts credential reloads
+type ReloadStats struct {
+	Successes   atomic.Uint64
+	Failures    atomic.Uint64
+	LastSuccess atomic.Int64 // unix seconds
+	LastFailure atomic.Int64 // unix seconds
+}
+
+// Stats holds the credential reload counters of this process
+var Stats = &ReloadStats{}
+
+// OnReload registers fn to be called with the new source after credentials are rotated
+func OnReload(fn func(*Source)) {
+	reloadHooksMu.Lock()
+	reloadHooks = append(reloadHooks, fn)
+	reloadHooksMu.Unlock()
+}
+
+// Watcher re-reads mounted credential files and swaps the credentials in use
+// when their contents change. Requests already sent keep the credentials they
+// were sent with; only new requests use the rotated ones.
+type Watcher struct {
+	cfg config.Config
+
+	mu               sync.Mutex
+	fingerprint      string
+	lastUnauthorized time.Time
+}
+
+// NewWatcher returns a watcher for the credential files of the current source
+// and of the TLS settings in cfg, and makes it the target of ReloadOnUnauthorized
+func NewWatcher(cfg config.Config) *Watcher {
+	w := &Watcher{cfg: cfg}
+	w.fingerprint = fingerprint(w.files(Current()))
+	watcher.Store(w)
+	return w
+}
+
+// Run polls the credential files every CredentialsReloadInterval until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	if w.cfg.CredentialsReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.cfg.CredentialsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check("file change")
+		}
+	}
+}
+
+// Check reloads the credentials if any watched file changed and reports whether
+// the credentials in use were replaced
+func (w *Watcher) Check(reason string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	fp := fingerprint(w.files(Current()))
+	if fp == w.fingerprint {
+		return false
+	}
+	// Remember the new contents even if they fail to load, so a broken file is
+	// reported once and retried when it changes again
+	w.fingerprint = fp
+
+	source, err := Load(w.cfg)
+	if err != nil {
+		Stats.Failures.Add(1)
+		Stats.LastFailure.Store(time.Now().Unix())
+		logger.Printf("Error reloading Rancher credentials after %s, keeping the previous credentials: %v", reason, err)
+		return false
+	}
+
+	SetCurrent(source)
+	// The new source may watch different files, e.g. a kubeconfig pointing at a new token file
+	w.fingerprint = fingerprint(w.files(source))
+	Stats.Successes.Add(1)
+	Stats.LastSuccess.Store(time.Now().Unix())
+	logger.Printf("Reloaded %s credentials after %s", source.Type, reason)
+
+	reloadHooksMu.Lock()
+	hooks := append([]func(*Source){}, reloadHooks...)
+	reloadHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(source)
+	}
+	return true
+}
+
+// files returns the credential and TLS files watched for source
+func (w *Watcher) files(source *Source) []string {
+	return append(append([]string{}, source.Files...),
+		nonEmpty(w.cfg.RancherCAFile, w.cfg.RancherClientCertFile, w.cfg.RancherClientKeyFile)...)
+}
+
+// ReloadOnUnauthorized is called when upstream rejected a request sent with
+// source. It reports whether newer credentials are now in use, re-reading the
+// credential files immediately if they have not been checked recently.
+func ReloadOnUnauthorized(source *Source) bool {
+	if Current() != source {
+		return true
+	}
+	w := watcher.Load()
+	if w == nil {
+		return false
+	}
+
+	w.mu.Lock()
+	recent := time.Since(w.lastUnauthorized) < unauthorizedRecheck
+	if !recent {
+		w.lastUnauthorized = time.Now()
+	}
+	w.mu.Unlock()
+	if recent {
+		return Current() != source
+	}
+
+	logger.Printf("Rancher rejected the %s credentials, re-reading credential files", source.Type)
+	w.Check("401 from upstream")
+	return Current() != source
+}
+
+// fingerprint hashes the paths and contents of files. Missing files hash as empty
+// so that a file appearing or disappearing counts as a change.
+func fingerprint(files []string) string {
+	h := sha256.New()
+	for _, path := range files {
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		if data, err := os.ReadFile(path); err == nil {
+			h.Write(data)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,127 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/metrics"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
+)
+
+var logger = logging.SetupLogging()
+
+// Labels identifying the cluster a merged series or stream came from
+const (
+	clusterIDLabel   = "cluster_id"
+	clusterNameLabel = "cluster_name"
+)
+
+// statusClientClosedRequest is recorded for cluster queries abandoned because
+// the client went away
+const statusClientClosedRequest = 499
+
+// clusterResponse holds the raw upstream response of one cluster
+type clusterResponse struct {
+	cluster    cluster.Cluster
+	statusCode int
+	body       []byte
+	err        error
+}
+
+// queryClusters sends the same GET request to every cluster in parallel using
+// the shared transport of upstream. The request URL for each cluster is
+// baseURL(cluster) + path with params encoded as the query string. header, if
+// set, returns extra request headers for a cluster. Each cluster query is
+// counted like a proxied GET request to the upstream.
+func queryClusters(ctx context.Context, upstream string, clusters []cluster.Cluster, baseURL func(string) string,
+	path string, params url.Values, header func(cluster.Cluster) http.Header) []clusterResponse {
+	client := transport.NewClient(upstream, 2*time.Minute)
+
+	responses := make([]clusterResponse, len(clusters))
+
+	var wg sync.WaitGroup
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(i int, c cluster.Cluster) {
+			defer wg.Done()
+
+			targetURL := strings.TrimSuffix(baseURL(c.ID), "/") + path
+			if encoded := params.Encode(); encoded != "" {
+				targetURL += "?" + encoded
+			}
+
+			var extra http.Header
+			if header != nil {
+				extra = header(c)
+			}
+			tracked := metrics.StartProxyRequest(c.ID, upstream, http.MethodGet)
+			statusCode, body, err := doQuery(ctx, client, targetURL, extra)
+			code := statusCode
+			if err != nil {
+				logger.Printf("Fan-out query to cluster %s failed: %v", c.ID, err)
+				metrics.RecordUpstreamError(c.ID, upstream, metrics.ClassifyError(err))
+				code = http.StatusBadGateway
+				if ctx.Err() != nil {
+					code = statusClientClosedRequest
+				}
+			} else if statusCode >= 500 {
+				metrics.RecordUpstreamError(c.ID, upstream, metrics.ErrorClass5xx)
+			}
+			tracked.Done(code, 0, int64(len(body)))
+			responses[i] = clusterResponse{cluster: c, statusCode: statusCode, body: body, err: err}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return responses
+}
+
+// doQuery performs a single authenticated GET against Rancher and returns the status and body
+func doQuery(ctx context.Context, client *http.Client, targetURL string, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", targetURL, http.NoBody)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error executing request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// requestParams returns the query string and form parameters of a GET or POST request
+func requestParams(r *http.Request) (url.Values, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return r.Form, nil
+}
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("Failed to encode fan-out response: %v", err)
+	}
+}
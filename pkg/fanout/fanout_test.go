@@ -0,0 +1,79 @@
+package fanout
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/metrics"
+)
+
+// counted returns the value of a relay metric with the given labels from the
+// metrics endpoint, or 0 if there is no such series
+func counted(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.MetricsHandler()(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, ok := families["rancher_monitoring_relay_"+name]
+	if !ok {
+		return 0
+	}
+series:
+	for _, m := range family.GetMetric() {
+		found := map[string]string{}
+		for _, l := range m.GetLabel() {
+			found[l.GetName()] = l.GetValue()
+		}
+		for k, v := range labels {
+			if found[k] != v {
+				continue series
+			}
+		}
+		if m.GetCounter() != nil {
+			return m.GetCounter().GetValue()
+		}
+		return float64(m.GetHistogram().GetSampleCount())
+	}
+	return 0
+}
+
+func TestQueryClustersIsInstrumented(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/c-fan-error/api/v1/query" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(vectorBody))
+	}))
+	defer upstream.Close()
+
+	baseURL := func(id string) string {
+		if id == "c-fan-down" {
+			return "http://127.0.0.1:1"
+		}
+		return upstream.URL + "/" + id
+	}
+	clusters := []cluster.Cluster{{ID: "c-fan-ok"}, {ID: "c-fan-error"}, {ID: "c-fan-down"}}
+	queryClusters(context.Background(), "prometheus", clusters, baseURL, "/api/v1/query", url.Values{"query": {"up"}}, nil)
+
+	for id, code := range map[string]string{"c-fan-ok": "200", "c-fan-error": "503", "c-fan-down": "502"} {
+		labels := map[string]string{"cluster_id": id, "service": "prometheus", "method": "GET", "code": code}
+		if got := counted(t, "proxy_requests_total", labels); got != 1 {
+			t.Errorf("proxy_requests_total%v = %v, want 1", labels, got)
+		}
+		if got := counted(t, "proxy_request_duration_seconds", labels); got != 1 {
+			t.Errorf("proxy_request_duration_seconds%v has %v observations, want 1", labels, got)
+		}
+	}
+	if got := counted(t, "proxy_response_bytes_total", map[string]string{"cluster_id": "c-fan-ok", "code": "200"}); got != float64(len(vectorBody)) {
+		t.Errorf("proxy_response_bytes_total = %v, want %d", got, len(vectorBody))
+	}
+}
@@ -0,0 +1,390 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/proxy"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/tenant"
+)
+
+// Label identifying the cluster a merged Loki stream came from
+const lokiClusterLabel = "cluster"
+
+// Loki defaults for query_range when the client does not send them
+const (
+	defaultLokiLimit     = 100
+	defaultLokiDirection = "backward"
+)
+
+// lokiResponse is the Loki HTTP API response envelope
+type lokiResponse struct {
+	Status   string          `json:"status"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// lokiQueryData is the data section of a query_range response
+type lokiQueryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// lokiStream is one stream of a "streams" result. Each entry is kept as raw
+// JSON so structured metadata sent by newer Loki versions is passed through.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values []json.RawMessage `json:"values"`
+}
+
+// lokiEntry is a single log line tagged with the stream it belongs to
+type lokiEntry struct {
+	streamKey string
+	timestamp int64
+	raw       json.RawMessage
+}
+
+// LokiQueryRangeHandler returns a handler that runs a LogQL range query against
+// the Loki of every relayed cluster. Log streams are merged in timestamp order
+// honouring the requested limit and direction; metric queries are merged like
+// PromQL results. Every stream or series carries a cluster label. Queries are
+// limited to the client's tenant when Loki tenants are configured.
+func LokiQueryRangeHandler() http.HandlerFunc {
+	tenants := tenant.NewLoki(config.Current())
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("LokiQueryRangeHandler")
+
+		params, orgID, ok := lokiParams(w, r, tenants, "/loki/api/v1/query_range")
+		if !ok {
+			return
+		}
+
+		limit := defaultLokiLimit
+		if value := params.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				writeJSON(w, http.StatusBadRequest, lokiResponse{Status: "error", Error: "invalid limit: " + value})
+				return
+			}
+		}
+		direction := strings.ToLower(params.Get("direction"))
+		if direction == "" {
+			direction = defaultLokiDirection
+		}
+		if direction != "forward" && direction != "backward" {
+			writeJSON(w, http.StatusBadRequest, lokiResponse{Status: "error", Error: "invalid direction: " + direction})
+			return
+		}
+
+		clusters := cluster.Default.List()
+		if len(clusters) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, lokiResponse{Status: "error", Error: "no clusters configured"})
+			return
+		}
+
+		responses := queryClusters(r.Context(), "loki", clusters, proxy.BuildLokiURL, "/loki/api/v1/query_range", params, orgID)
+		statusCode, merged := mergeLokiQueryResponses(responses, limit, direction)
+		writeJSON(w, statusCode, merged)
+	}
+}
+
+// LokiLabelsHandler returns a handler that lists the union of label names known
+// to the Loki of every relayed cluster, including the cluster label itself.
+func LokiLabelsHandler() http.HandlerFunc {
+	tenants := tenant.NewLoki(config.Current())
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("LokiLabelsHandler")
+
+		params, orgID, ok := lokiParams(w, r, tenants, "/loki/api/v1/labels")
+		if !ok {
+			return
+		}
+
+		clusters := cluster.Default.List()
+		if len(clusters) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, lokiResponse{Status: "error", Error: "no clusters configured"})
+			return
+		}
+
+		responses := queryClusters(r.Context(), "loki", clusters, proxy.BuildLokiURL, "/loki/api/v1/labels", params, orgID)
+
+		names := map[string]bool{lokiClusterLabel: true, clusterNameLabel: true}
+		var warnings []string
+		failed := 0
+		for _, resp := range responses {
+			parsed, err := parseLokiResponse(resp)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("cluster %s: %v", resp.cluster.ID, err))
+				failed++
+				continue
+			}
+
+			var labels []string
+			if err := json.Unmarshal(parsed.Data, &labels); err != nil {
+				warnings = append(warnings, fmt.Sprintf("cluster %s: error decoding labels: %v", resp.cluster.ID, err))
+				failed++
+				continue
+			}
+			for _, label := range labels {
+				names[label] = true
+			}
+		}
+
+		if failed == len(responses) {
+			writeJSON(w, http.StatusBadGateway, lokiResponse{Status: "error", Error: "no cluster answered", Warnings: warnings})
+			return
+		}
+
+		labels := make([]string, 0, len(names))
+		for name := range names {
+			labels = append(labels, name)
+		}
+		sort.Strings(labels)
+
+		data, err := json.Marshal(labels)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, lokiResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, lokiResponse{Status: "success", Data: data, Warnings: warnings})
+	}
+}
+
+// lokiParams returns the parameters of a fan-out request for apiPath limited to
+// the client's tenant, and the X-Scope-OrgID header to send to each cluster. An
+// error response is written when the request is refused.
+func lokiParams(w http.ResponseWriter, r *http.Request, tenants *tenant.Loki, apiPath string) (url.Values, func(cluster.Cluster) http.Header, bool) {
+	params, err := requestParams(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, lokiResponse{Status: "error", Error: err.Error()})
+		return nil, nil, false
+	}
+	if tenants == nil {
+		return params, nil, true
+	}
+
+	params, orgID, err := tenants.Enforce(r, apiPath, params)
+	if err != nil {
+		logger.Printf("Refused fan-out query: %v", err)
+		status := http.StatusBadRequest
+		if tenantErr, ok := err.(*tenant.Error); ok {
+			status = tenantErr.Status
+		}
+		writeJSON(w, status, lokiResponse{Status: "error", Error: err.Error()})
+		return nil, nil, false
+	}
+	return params, func(c cluster.Cluster) http.Header {
+		header := make(http.Header)
+		if value := orgID.For(c); value != "" {
+			header.Set(tenant.OrgIDHeader, value)
+		}
+		return header
+	}, true
+}
+
+// parseLokiResponse decodes a cluster response and turns Loki errors into Go errors
+func parseLokiResponse(resp clusterResponse) (lokiResponse, error) {
+	if resp.err != nil {
+		return lokiResponse{}, resp.err
+	}
+
+	var parsed lokiResponse
+	if err := json.Unmarshal(resp.body, &parsed); err != nil || resp.statusCode != http.StatusOK {
+		// Loki returns plain text bodies for most errors
+		message := strings.TrimSpace(string(resp.body))
+		if len(message) > 200 {
+			message = message[:200]
+		}
+		return lokiResponse{}, fmt.Errorf("status code %d: %s", resp.statusCode, message)
+	}
+	if parsed.Status != "success" {
+		return lokiResponse{}, fmt.Errorf("%s", parsed.Error)
+	}
+	return parsed, nil
+}
+
+// mergeLokiQueryResponses combines per-cluster query_range results into a single response
+func mergeLokiQueryResponses(responses []clusterResponse, limit int, direction string) (int, lokiResponse) {
+	var (
+		resultType string
+		entries    []lokiEntry
+		streams    = make(map[string]map[string]string)
+		series     []prometheusSeries
+		warnings   []string
+		failed     int
+		firstErr   error
+	)
+	// fail records a cluster that contributes nothing to the result
+	fail := func(c cluster.Cluster, err error) {
+		warnings = append(warnings, fmt.Sprintf("cluster %s: %v", c.ID, err))
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+	}
+
+	for _, resp := range responses {
+		c := resp.cluster
+		parsed, err := parseLokiResponse(resp)
+		if err != nil {
+			fail(c, err)
+			continue
+		}
+		for _, warning := range parsed.Warnings {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %s", c.ID, warning))
+		}
+
+		var data lokiQueryData
+		if err := json.Unmarshal(parsed.Data, &data); err != nil {
+			fail(c, fmt.Errorf("error decoding result: %v", err))
+			continue
+		}
+		if data.ResultType != "streams" && data.ResultType != "vector" && data.ResultType != "matrix" {
+			fail(c, fmt.Errorf("result type %s cannot be merged", data.ResultType))
+			continue
+		}
+		if resultType == "" {
+			resultType = data.ResultType
+		} else if data.ResultType != resultType {
+			fail(c, fmt.Errorf("result type %s does not match %s", data.ResultType, resultType))
+			continue
+		}
+
+		switch data.ResultType {
+		case "streams":
+			clusterEntries, err := collectLokiEntries(c, data.Result, streams)
+			if err != nil {
+				fail(c, err)
+				continue
+			}
+			entries = append(entries, clusterEntries...)
+		case "vector", "matrix":
+			clusterSeries, _, err := prometheusResultSeries(&prometheusData{ResultType: data.ResultType, Result: data.Result})
+			if err != nil {
+				fail(c, err)
+				continue
+			}
+			for i := range clusterSeries {
+				if clusterSeries[i].Metric == nil {
+					clusterSeries[i].Metric = make(map[string]string)
+				}
+				clusterSeries[i].Metric[lokiClusterLabel] = c.ID
+				clusterSeries[i].Metric[clusterNameLabel] = c.DisplayName()
+			}
+			series = append(series, clusterSeries...)
+		}
+	}
+
+	if failed == len(responses) {
+		return http.StatusBadGateway, lokiResponse{Status: "error", Error: firstErr.Error(), Warnings: warnings}
+	}
+
+	var result interface{}
+	switch resultType {
+	case "vector", "matrix":
+		result = series
+	default:
+		resultType = "streams"
+		result = limitLokiEntries(entries, streams, limit, direction)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"resultType": resultType, "result": result})
+	if err != nil {
+		return http.StatusInternalServerError, lokiResponse{Status: "error", Error: err.Error()}
+	}
+	return http.StatusOK, lokiResponse{Status: "success", Data: data, Warnings: warnings}
+}
+
+// collectLokiEntries flattens the streams of one cluster into entries, registering
+// each stream's labels (including the cluster labels) in streams
+func collectLokiEntries(c cluster.Cluster, result json.RawMessage, streams map[string]map[string]string) ([]lokiEntry, error) {
+	var clusterStreams []lokiStream
+	if err := json.Unmarshal(result, &clusterStreams); err != nil {
+		return nil, fmt.Errorf("error decoding streams: %v", err)
+	}
+
+	var entries []lokiEntry
+	for _, stream := range clusterStreams {
+		labels := make(map[string]string, len(stream.Stream)+2)
+		for name, value := range stream.Stream {
+			labels[name] = value
+		}
+		labels[lokiClusterLabel] = c.ID
+		labels[clusterNameLabel] = c.DisplayName()
+
+		key := streamKey(labels)
+		streams[key] = labels
+
+		for _, raw := range stream.Values {
+			var fields []json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil || len(fields) < 2 {
+				return nil, fmt.Errorf("invalid log entry %s", raw)
+			}
+			var ts string
+			if err := json.Unmarshal(fields[0], &ts); err != nil {
+				return nil, fmt.Errorf("invalid log entry timestamp %s", fields[0])
+			}
+			timestamp, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid log entry timestamp %q", ts)
+			}
+			entries = append(entries, lokiEntry{streamKey: key, timestamp: timestamp, raw: raw})
+		}
+	}
+	return entries, nil
+}
+
+// limitLokiEntries orders entries by timestamp in the requested direction, keeps
+// the first limit entries and groups them back into streams
+func limitLokiEntries(entries []lokiEntry, streams map[string]map[string]string, limit int, direction string) []lokiStream {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if direction == "forward" {
+			return entries[i].timestamp < entries[j].timestamp
+		}
+		return entries[i].timestamp > entries[j].timestamp
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	var order []string
+	grouped := make(map[string]*lokiStream)
+	for _, entry := range entries {
+		stream, ok := grouped[entry.streamKey]
+		if !ok {
+			stream = &lokiStream{Stream: streams[entry.streamKey]}
+			grouped[entry.streamKey] = stream
+			order = append(order, entry.streamKey)
+		}
+		stream.Values = append(stream.Values, entry.raw)
+	}
+
+	result := make([]lokiStream, 0, len(order))
+	for _, key := range order {
+		result = append(result, *grouped[key])
+	}
+	return result
+}
+
+// streamKey returns a stable identifier for a label set
+func streamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return b.String()
+}
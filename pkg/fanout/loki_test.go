@@ -0,0 +1,221 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// streamsBody returns a Loki streams result with one stream per app holding
+// entries at the given timestamps
+func streamsBody(entries map[string][]int64) string {
+	var streams []string
+	for _, app := range []string{"api", "web"} {
+		timestamps, ok := entries[app]
+		if !ok {
+			continue
+		}
+		var values []string
+		for _, ts := range timestamps {
+			values = append(values, fmt.Sprintf(`["%d","%s line %d"]`, ts, app, ts))
+		}
+		streams = append(streams, fmt.Sprintf(`{"stream":{"app":%q},"values":[%s]}`, app, strings.Join(values, ",")))
+	}
+	return `{"status":"success","data":{"resultType":"streams","result":[` + strings.Join(streams, ",") + `]}}`
+}
+
+// mergedLine is a log line of the merged result with the stream it belongs to
+type mergedLine struct {
+	Cluster string
+	App     string
+	Line    string
+}
+
+// mergedLines flattens a merged streams result in stream order
+func mergedLines(t *testing.T, data json.RawMessage) []mergedLine {
+	t.Helper()
+	var result struct {
+		ResultType string       `json:"resultType"`
+		Result     []lokiStream `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ResultType != "streams" {
+		t.Fatalf("result type %s, want streams", result.ResultType)
+	}
+	var lines []mergedLine
+	for _, stream := range result.Result {
+		for _, raw := range stream.Values {
+			var entry []string
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, mergedLine{Cluster: stream.Stream[lokiClusterLabel], App: stream.Stream["app"], Line: entry[1]})
+		}
+	}
+	return lines
+}
+
+func TestMergeLokiQueryResponses(t *testing.T) {
+	west := answer("c-1", 200, streamsBody(map[string][]int64{"api": {10, 40}, "web": {30}}))
+	east := answer("c-2", 200, streamsBody(map[string][]int64{"api": {20, 50}}))
+
+	tests := []struct {
+		name         string
+		responses    []clusterResponse
+		limit        int
+		direction    string
+		want         []mergedLine
+		wantWarnings []string
+	}{
+		{
+			name:      "backward",
+			responses: []clusterResponse{west, east},
+			limit:     100,
+			direction: "backward",
+			want: []mergedLine{
+				{"c-2", "api", "api line 50"},
+				{"c-2", "api", "api line 20"},
+				{"c-1", "api", "api line 40"},
+				{"c-1", "api", "api line 10"},
+				{"c-1", "web", "web line 30"},
+			},
+		},
+		{
+			name:      "forward",
+			responses: []clusterResponse{west, east},
+			limit:     100,
+			direction: "forward",
+			want: []mergedLine{
+				{"c-1", "api", "api line 10"},
+				{"c-1", "api", "api line 40"},
+				{"c-2", "api", "api line 20"},
+				{"c-2", "api", "api line 50"},
+				{"c-1", "web", "web line 30"},
+			},
+		},
+		{
+			name:      "limit applies after the merge backward",
+			responses: []clusterResponse{west, east},
+			limit:     3,
+			direction: "backward",
+			want: []mergedLine{
+				{"c-2", "api", "api line 50"},
+				{"c-1", "api", "api line 40"},
+				{"c-1", "web", "web line 30"},
+			},
+		},
+		{
+			name:      "limit applies after the merge forward",
+			responses: []clusterResponse{west, east},
+			limit:     2,
+			direction: "forward",
+			want: []mergedLine{
+				{"c-1", "api", "api line 10"},
+				{"c-2", "api", "api line 20"},
+			},
+		},
+		{
+			name:      "partial failure",
+			responses: []clusterResponse{west, unreachable("c-2"), answer("c-3", 400, "parse error at line 1, col 5")},
+			limit:     100,
+			direction: "forward",
+			want: []mergedLine{
+				{"c-1", "api", "api line 10"},
+				{"c-1", "api", "api line 40"},
+				{"c-1", "web", "web line 30"},
+			},
+			wantWarnings: []string{
+				"cluster c-2: error executing request: connection refused",
+				"cluster c-3: status code 400: parse error at line 1, col 5",
+			},
+		},
+		{
+			name:      "unmergeable result of one cluster",
+			responses: []clusterResponse{answer("c-0", 200, `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`), east},
+			limit:     1,
+			direction: "backward",
+			want:      []mergedLine{{"c-2", "api", "api line 50"}},
+			wantWarnings: []string{
+				"cluster c-0: result type scalar cannot be merged",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, merged := mergeLokiQueryResponses(tt.responses, tt.limit, tt.direction)
+			if code != http.StatusOK || merged.Status != "success" {
+				t.Fatalf("got %d %+v", code, merged)
+			}
+			if got := mergedLines(t, merged.Data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines\n got %v\nwant %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(merged.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings\n got %q\nwant %q", merged.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestMergeLokiQueryResponsesFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []clusterResponse
+		wantError string
+	}{
+		{
+			name:      "all unreachable",
+			responses: []clusterResponse{unreachable("c-1"), unreachable("c-2")},
+			wantError: "error executing request: connection refused",
+		},
+		{
+			name:      "all undecodable",
+			responses: []clusterResponse{answer("c-1", 200, `{"status":"success","data":[]}`), answer("c-2", 200, `{"status":"success","data":{"resultType":"streams","result":[{"stream":{},"values":[["x","y"]]}]}}`)},
+			wantError: "error decoding result: json: cannot unmarshal array into Go value of type fanout.lokiQueryData",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, merged := mergeLokiQueryResponses(tt.responses, 100, "backward")
+			if code != http.StatusBadGateway || merged.Status != "error" {
+				t.Fatalf("got %d %+v, want a 502 error", code, merged)
+			}
+			if merged.Error != tt.wantError {
+				t.Errorf("error %q, want %q", merged.Error, tt.wantError)
+			}
+			if len(merged.Warnings) != len(tt.responses) {
+				t.Errorf("warnings %q, want one per cluster", merged.Warnings)
+			}
+		})
+	}
+}
+
+func TestMergeLokiMetricQueries(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"level":"error"},"values":[[1700000000,"3"]]}]}}`
+	code, merged := mergeLokiQueryResponses([]clusterResponse{answer("c-1", 200, body), answer("c-2", 200, body)}, 100, "backward")
+	if code != http.StatusOK {
+		t.Fatalf("got %d %+v", code, merged)
+	}
+
+	var result struct {
+		ResultType string             `json:"resultType"`
+		Result     []prometheusSeries `json:"result"`
+	}
+	if err := json.Unmarshal(merged.Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ResultType != "matrix" || len(result.Result) != 2 {
+		t.Fatalf("got %s with %d series, want matrix with 2", result.ResultType, len(result.Result))
+	}
+	for i, id := range []string{"c-1", "c-2"} {
+		if got := result.Result[i].Metric; got[lokiClusterLabel] != id || got[clusterNameLabel] != "name-"+id || got["level"] != "error" {
+			t.Errorf("series %d labels %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/proxy"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/tenant"
+)
+
+// prometheusResponse is the Prometheus HTTP API response envelope
+type prometheusResponse struct {
+	Status    string          `json:"status"`
+	Data      *prometheusData `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	Infos     []string        `json:"infos,omitempty"`
+}
+
+// prometheusData is the data section of a query or query_range response
+type prometheusData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// prometheusSeries is one element of a vector or matrix result. Sample values
+// are kept as raw JSON so they are passed through exactly as Prometheus sent them.
+type prometheusSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Value      json.RawMessage   `json:"value,omitempty"`
+	Values     json.RawMessage   `json:"values,omitempty"`
+	Histogram  json.RawMessage   `json:"histogram,omitempty"`
+	Histograms json.RawMessage   `json:"histograms,omitempty"`
+}
+
+// PrometheusQueryHandler returns a handler that runs a PromQL instant or range
+// query (depending on apiPath, e.g. "/api/v1/query") against the Prometheus of
+// every relayed cluster and merges the results. Each series is labelled with
+// cluster_id and cluster_name. Clusters that fail are reported as warnings.
+// Queries are limited to the client's tenant when tenants are configured.
+func PrometheusQueryHandler(apiPath string) http.HandlerFunc {
+	tenants := tenant.NewPrometheus(config.Current().PrometheusTenants)
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("PrometheusQueryHandler: %s", apiPath)
+
+		params, err := requestParams(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, prometheusResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+			return
+		}
+		if tenants != nil {
+			if params, err = tenants.Enforce(r, apiPath, params); err != nil {
+				logger.Printf("Refused fan-out query: %v", err)
+				status, errorType := http.StatusBadRequest, "bad_data"
+				if tenantErr, ok := err.(*tenant.Error); ok && tenantErr.Status == http.StatusForbidden {
+					status, errorType = http.StatusForbidden, "forbidden"
+				}
+				writeJSON(w, status, prometheusResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+				return
+			}
+		}
+
+		clusters := cluster.Default.List()
+		if len(clusters) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, prometheusResponse{Status: "error", ErrorType: "unavailable", Error: "no clusters configured"})
+			return
+		}
+
+		responses := queryClusters(r.Context(), "prometheus", clusters, proxy.BuildPrometheusURL, apiPath, params, nil)
+		statusCode, merged := mergePrometheusResponses(responses)
+		writeJSON(w, statusCode, merged)
+	}
+}
+
+// mergePrometheusResponses combines per-cluster query results into a single response
+func mergePrometheusResponses(responses []clusterResponse) (int, prometheusResponse) {
+	var (
+		resultType string
+		series     = []prometheusSeries{}
+		warnings   []string
+		infos      []string
+		failures   []prometheusResponse
+	)
+
+	for _, resp := range responses {
+		c := resp.cluster
+		if resp.err != nil {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %v", c.ID, resp.err))
+			failures = append(failures, prometheusResponse{ErrorType: "unavailable", Error: resp.err.Error()})
+			continue
+		}
+
+		var parsed prometheusResponse
+		if err := json.Unmarshal(resp.body, &parsed); err != nil {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: unexpected response (status %d)", c.ID, resp.statusCode))
+			failures = append(failures, prometheusResponse{ErrorType: "unavailable", Error: fmt.Sprintf("status code %d", resp.statusCode)})
+			continue
+		}
+		if parsed.Status != "success" || parsed.Data == nil {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %s", c.ID, parsed.Error))
+			failures = append(failures, parsed)
+			continue
+		}
+
+		for _, warning := range parsed.Warnings {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %s", c.ID, warning))
+		}
+		for _, info := range parsed.Infos {
+			infos = append(infos, fmt.Sprintf("cluster %s: %s", c.ID, info))
+		}
+
+		clusterSeries, clusterType, err := prometheusResultSeries(parsed.Data)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %v", c.ID, err))
+			failures = append(failures, prometheusResponse{ErrorType: "unavailable", Error: err.Error()})
+			continue
+		}
+		if resultType == "" {
+			resultType = clusterType
+		} else if clusterType != resultType {
+			err := fmt.Errorf("result type %s does not match %s", clusterType, resultType)
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %v", c.ID, err))
+			failures = append(failures, prometheusResponse{ErrorType: "unavailable", Error: err.Error()})
+			continue
+		}
+
+		for i := range clusterSeries {
+			if clusterSeries[i].Metric == nil {
+				clusterSeries[i].Metric = make(map[string]string)
+			}
+			clusterSeries[i].Metric[clusterIDLabel] = c.ID
+			clusterSeries[i].Metric[clusterNameLabel] = c.DisplayName()
+		}
+		series = append(series, clusterSeries...)
+	}
+
+	// Only fail the whole query when no cluster answered
+	if len(failures) == len(responses) {
+		statusCode, failure := http.StatusBadGateway, failures[0]
+		if failure.ErrorType == "bad_data" {
+			statusCode = http.StatusBadRequest
+		}
+		return statusCode, prometheusResponse{
+			Status:    "error",
+			ErrorType: failure.ErrorType,
+			Error:     failure.Error,
+			Warnings:  warnings,
+		}
+	}
+
+	if resultType == "" {
+		resultType = "vector"
+	}
+	result, err := json.Marshal(series)
+	if err != nil {
+		return http.StatusInternalServerError, prometheusResponse{Status: "error", ErrorType: "internal", Error: err.Error()}
+	}
+
+	return http.StatusOK, prometheusResponse{
+		Status:   "success",
+		Data:     &prometheusData{ResultType: resultType, Result: result},
+		Warnings: warnings,
+		Infos:    infos,
+	}
+}
+
+// prometheusResultSeries decodes a query result into series. Scalar results
+// are turned into a single-sample vector so they can carry cluster labels.
+func prometheusResultSeries(data *prometheusData) ([]prometheusSeries, string, error) {
+	switch data.ResultType {
+	case "vector", "matrix":
+		var series []prometheusSeries
+		if err := json.Unmarshal(data.Result, &series); err != nil {
+			return nil, "", fmt.Errorf("error decoding %s result: %v", data.ResultType, err)
+		}
+		return series, data.ResultType, nil
+	case "scalar":
+		return []prometheusSeries{{Value: data.Result}}, "vector", nil
+	default:
+		return nil, "", fmt.Errorf("result type %s cannot be merged", data.ResultType)
+	}
+}
@@ -0,0 +1,155 @@
+package fanout
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+)
+
+// answer returns the response of a cluster with the given status and body
+func answer(id string, statusCode int, body string) clusterResponse {
+	return clusterResponse{cluster: cluster.Cluster{ID: id, Name: "name-" + id}, statusCode: statusCode, body: []byte(body)}
+}
+
+// unreachable returns the response of a cluster that could not be queried
+func unreachable(id string) clusterResponse {
+	return clusterResponse{cluster: cluster.Cluster{ID: id}, err: errors.New("error executing request: connection refused")}
+}
+
+const (
+	vectorBody = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"node"},"value":[1700000000,"1"]}]}}`
+	matrixBody = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"node"},"values":[[1700000000,"1"]]}]}}`
+	scalarBody = `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"42"]}}`
+	stringBody = `{"status":"success","data":{"resultType":"string","result":[1700000000,"x"]}}`
+	badData    = `{"status":"error","errorType":"bad_data","error":"parse error at char 4"}`
+)
+
+func TestMergePrometheusResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []clusterResponse
+		wantCode     int
+		wantStatus   string
+		wantType     string
+		wantClusters []string
+		wantWarnings []string
+	}{
+		{
+			name:         "vectors",
+			responses:    []clusterResponse{answer("c-1", 200, vectorBody), answer("c-2", 200, vectorBody)},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "vector",
+			wantClusters: []string{"c-1", "c-2"},
+		},
+		{
+			name:         "matrices",
+			responses:    []clusterResponse{answer("c-1", 200, matrixBody), answer("c-2", 200, matrixBody)},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "matrix",
+			wantClusters: []string{"c-1", "c-2"},
+		},
+		{
+			name:         "scalars become a vector",
+			responses:    []clusterResponse{answer("c-1", 200, scalarBody), answer("c-2", 200, vectorBody)},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "vector",
+			wantClusters: []string{"c-1", "c-2"},
+		},
+		{
+			name:         "mixed result types",
+			responses:    []clusterResponse{answer("c-1", 200, vectorBody), answer("c-2", 200, matrixBody)},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "vector",
+			wantClusters: []string{"c-1"},
+			wantWarnings: []string{"cluster c-2: result type matrix does not match vector"},
+		},
+		{
+			name:         "partial failure",
+			responses:    []clusterResponse{answer("c-1", 200, vectorBody), unreachable("c-2"), answer("c-3", 502, "<html>Bad Gateway</html>")},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "vector",
+			wantClusters: []string{"c-1"},
+			wantWarnings: []string{"cluster c-2: error executing request: connection refused", "cluster c-3: unexpected response (status 502)"},
+		},
+		{
+			name:         "all unreachable",
+			responses:    []clusterResponse{unreachable("c-1"), unreachable("c-2")},
+			wantCode:     http.StatusBadGateway,
+			wantStatus:   "error",
+			wantWarnings: []string{"cluster c-1: error executing request: connection refused", "cluster c-2: error executing request: connection refused"},
+		},
+		{
+			name:         "all undecodable results",
+			responses:    []clusterResponse{answer("c-1", 200, `{"status":"success","data":{"resultType":"vector","result":{}}}`), answer("c-2", 200, stringBody)},
+			wantCode:     http.StatusBadGateway,
+			wantStatus:   "error",
+			wantWarnings: []string{"cluster c-1: error decoding vector result: json: cannot unmarshal object into Go value of type []fanout.prometheusSeries", "cluster c-2: result type string cannot be merged"},
+		},
+		{
+			name:         "bad query everywhere",
+			responses:    []clusterResponse{answer("c-1", 400, badData), answer("c-2", 400, badData)},
+			wantCode:     http.StatusBadRequest,
+			wantStatus:   "error",
+			wantWarnings: []string{"cluster c-1: parse error at char 4", "cluster c-2: parse error at char 4"},
+		},
+		{
+			name:         "empty results",
+			responses:    []clusterResponse{answer("c-1", 200, `{"status":"success","data":{"resultType":"vector","result":[]}}`)},
+			wantCode:     http.StatusOK,
+			wantStatus:   "success",
+			wantType:     "vector",
+			wantClusters: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, merged := mergePrometheusResponses(tt.responses)
+			if code != tt.wantCode || merged.Status != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d %s: %+v", code, merged.Status, tt.wantCode, tt.wantStatus, merged)
+			}
+			if !reflect.DeepEqual(merged.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings\n got %q\nwant %q", merged.Warnings, tt.wantWarnings)
+			}
+			if merged.Status != "success" {
+				if merged.Data != nil || merged.Error == "" {
+					t.Errorf("error response carries data %v or no error", merged.Data)
+				}
+				return
+			}
+
+			if merged.Data.ResultType != tt.wantType {
+				t.Errorf("result type %s, want %s", merged.Data.ResultType, tt.wantType)
+			}
+			var series []prometheusSeries
+			if err := json.Unmarshal(merged.Data.Result, &series); err != nil {
+				t.Fatal(err)
+			}
+			var clusters []string
+			for _, s := range series {
+				if s.Metric[clusterNameLabel] != "name-"+s.Metric[clusterIDLabel] {
+					t.Errorf("series %v lacks the cluster labels", s.Metric)
+				}
+				clusters = append(clusters, s.Metric[clusterIDLabel])
+			}
+			sort.Strings(clusters)
+			if !reflect.DeepEqual(clusters, tt.wantClusters) {
+				t.Errorf("series of clusters %v, want %v", clusters, tt.wantClusters)
+			}
+			if strings.Contains(string(merged.Data.Result), "null") {
+				t.Errorf("result contains null: %s", merged.Data.Result)
+			}
+		})
+	}
+}
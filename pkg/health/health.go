@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
+	"strings"
+	"sync/atomic"
 
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
-	"github.com/supporttools/rancher-centralized-monitoring/pkg/proxy"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/reload"
 )
 
 // VersionInfo represents the structure of version information.
@@ -29,82 +31,171 @@ var GitCommit = "MISSING GIT COMMIT"
 // BuildTime holds the timestamp of when the build was created. It's set during the build process.
 var BuildTime = "MISSING BUILD TIME"
 
-// HealthzHandler returns an HTTP handler function that checks Rancher API connectivity.
+// shuttingDown is set once the relay has started to shut down
+var shuttingDown atomic.Bool
+
+// SetShuttingDown makes /ready fail so that load balancers stop sending new
+// requests while in-flight ones finish
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// HealthzHandler returns an HTTP handler function that reports the last
+// Rancher API check and whether the Kubernetes API of each relayed cluster
+// was reachable. Results come from the background prober.
 func HealthzHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("HealthzHandler")
 
-		// Test basic Rancher API connectivity
-		client := &http.Client{Timeout: 10 * time.Second}
-		req, err := http.NewRequest("GET", config.CFG.RancherApiEndpoint, http.NoBody)
-		if err != nil {
-			logger.Printf("HealthzHandler: Failed to create request: %v", err)
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		if err := probes.state(checkKey{}).problem(); err != nil {
+			logger.Printf("HealthzHandler: Rancher API check failed: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service Unavailable\nrancher: %v\n", err)
 			return
 		}
-		req.SetBasicAuth(config.CFG.RancherApiAccessKey, config.CFG.RancherApiSecretKey)
 
-		resp, err := client.Do(req)
-		if err != nil {
-			logger.Printf("HealthzHandler: Failed to connect to Rancher API: %v", err)
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			logger.Printf("HealthzHandler: Rancher API returned status: %d", resp.StatusCode)
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			return
-		}
-
-		logger.Printf("HealthzHandler: Rancher API is reachable")
-		fmt.Fprintf(w, "ok")
+		// Downstream cluster failures are reported but do not fail liveness
+		fmt.Fprintf(w, "ok\n")
+		writeClusterResults(w, checkClusters(selectClusters(r), clusterAPIProblems))
 	}
 }
 
-// ReadyzHandler returns an HTTP handler function that checks service connectivity via proxy.
+// ReadyzHandler returns an HTTP handler function that reports whether enough
+// relayed clusters have every critical upstream reachable via proxy, or whether
+// the cluster named by the ?cluster= query parameter does. Optional upstreams
+// are listed but do not fail the check. Results come from the background prober.
 func ReadyzHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("ReadyzHandler")
+		writeReadiness(w, selectClusters(r), r.URL.Query().Get("cluster") == "", readinessProblems)
+	}
+}
 
-		// Test connectivity to configured remote services
-		allHealthy := true
+// ServiceReadyzHandler returns an HTTP handler function for /ready/{service}
+// that reports whether a single upstream is reachable in enough relayed
+// clusters, or in the cluster named by ?cluster=. The readiness policy of the
+// upstream does not apply: a cluster counts as not ready whenever the upstream
+// is unhealthy in it. A name that is not an upstream is looked up as a cluster
+// ID or name and /ready/{cluster} reports the readiness of that cluster alone.
+func ServiceReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/ready/")
+		logger.Printf("ServiceReadyzHandler: %s", name)
 
-		// Test Loki if configured
-		if config.CFG.LokiNamespace != "" && config.CFG.LokiService != "" {
-			lokiURL := proxy.BuildLokiURL()
-			if err := proxy.TestServiceConnectivity(lokiURL, "loki"); err != nil {
-				logger.Printf("ReadyzHandler: Loki service check failed: %v", err)
-				allHealthy = false
-			}
+		if _, ok := config.Current().Upstream(name); ok {
+			writeReadiness(w, selectClusters(r), r.URL.Query().Get("cluster") == "", serviceProblems(name))
+			return
 		}
+		if c, ok := cluster.Default.Lookup(name); ok {
+			writeReadiness(w, []cluster.Cluster{c}, false, readinessProblems)
+			return
+		}
+		http.Error(w, "Unknown service or cluster", http.StatusNotFound)
+	}
+}
+
+// writeReadiness answers a readiness check. It fails while shutting down, when
+// no cluster is selected or when too few clusters are ready, see ready.
+func writeReadiness(w http.ResponseWriter, clusters []cluster.Cluster, all bool, problems func(cluster.Cluster) ([]error, []error)) {
+	if shuttingDown.Load() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(clusters) == 0 {
+		logger.Printf("Readiness check: No clusters configured")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	results := checkClusters(clusters, problems)
+	if !ready(results, all) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service Unavailable\n%d of %d cluster(s) ready, %d required\n", readyClusters(results), len(results), requiredClusters(results, all))
+		writeClusterResults(w, results)
+		return
+	}
+
+	fmt.Fprintf(w, "ok\n")
+	writeClusterResults(w, results)
+}
+
+// ready reports whether enough clusters have no errors; warnings do not count.
+// When all relayed clusters are checked a cluster that is down does not take
+// the relay out of service for the others, see requiredClusters.
+func ready(results []clusterResult, all bool) bool {
+	return len(results) > 0 && readyClusters(results) >= requiredClusters(results, all)
+}
 
-		// Test Prometheus if configured
-		if config.CFG.PrometheusNamespace != "" && config.CFG.PrometheusService != "" {
-			prometheusURL := proxy.BuildPrometheusURL()
-			if err := proxy.TestServiceConnectivity(prometheusURL, "prometheus"); err != nil {
-				logger.Printf("ReadyzHandler: Prometheus service check failed: %v", err)
-				allHealthy = false
-			}
+// readyClusters returns the number of clusters without errors
+func readyClusters(results []clusterResult) int {
+	n := 0
+	for _, result := range results {
+		if len(result.errors) == 0 {
+			n++
 		}
+	}
+	return n
+}
 
-		// Test remote service if configured
-		if config.CFG.RemoteNamespace != "" && config.CFG.RemoteService != "" && config.CFG.RemotePort != "" {
-			remoteURL := proxy.BuildServiceProxyURL(config.CFG.RemoteNamespace, config.CFG.RemoteService, config.CFG.RemotePort)
-			if err := proxy.TestServiceConnectivity(remoteURL, config.CFG.RemoteService); err != nil {
-				logger.Printf("ReadyzHandler: Remote service check failed: %v", err)
-				allHealthy = false
-			}
+// requiredClusters returns how many of the checked clusters must be ready:
+// ReadyMinClusters, or every one of them when fewer are checked or the
+// clusters were selected by name
+func requiredClusters(results []clusterResult, all bool) int {
+	if minimum := config.Current().ReadyMinClusters; all && minimum < len(results) {
+		return minimum
+	}
+	return len(results)
+}
+
+// clusterResult holds the outcome of checking a single cluster. Warnings are
+// problems that are reported without failing the check.
+type clusterResult struct {
+	cluster  cluster.Cluster
+	errors   []error
+	warnings []error
+}
+
+// selectClusters returns the cluster named by the ?cluster= query parameter, or all clusters
+func selectClusters(r *http.Request) []cluster.Cluster {
+	if key := r.URL.Query().Get("cluster"); key != "" {
+		if c, ok := cluster.Default.Lookup(key); ok {
+			return []cluster.Cluster{c}
 		}
+		return nil
+	}
+	return cluster.Default.List()
+}
 
-		if !allHealthy {
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			return
+// checkClusters collects the problems of every cluster
+func checkClusters(clusters []cluster.Cluster, problems func(cluster.Cluster) ([]error, []error)) []clusterResult {
+	results := make([]clusterResult, 0, len(clusters))
+	for _, c := range clusters {
+		errs, warnings := problems(c)
+		results = append(results, clusterResult{cluster: c, errors: errs, warnings: warnings})
+	}
+	return results
+}
+
+// writeClusterResults writes one line per cluster describing its check result
+func writeClusterResults(w http.ResponseWriter, results []clusterResult) {
+	for _, result := range results {
+		if len(result.errors) == 0 && len(result.warnings) == 0 {
+			fmt.Fprintf(w, "cluster %s (%s): ok\n", result.cluster.ID, result.cluster.DisplayName())
+			continue
+		}
+		for _, err := range append(result.errors, result.warnings...) {
+			fmt.Fprintf(w, "cluster %s (%s): %v\n", result.cluster.ID, result.cluster.DisplayName(), err)
 		}
+	}
+}
 
-		logger.Printf("ReadyzHandler: All configured services are reachable")
-		fmt.Fprintf(w, "ok")
+// Info returns the version the relay was built from
+func Info() VersionInfo {
+	return VersionInfo{
+		Version:   version,
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
 	}
 }
 
@@ -113,16 +204,23 @@ func VersionHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("VersionHandler")
 
-		versionInfo := VersionInfo{
-			Version:   version,
-			GitCommit: GitCommit,
-			BuildTime: BuildTime,
-		}
-
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(versionInfo); err != nil {
+		if err := json.NewEncoder(w).Encode(Info()); err != nil {
 			logger.Printf("Failed to encode version info to JSON: %v", err)
 			http.Error(w, "Failed to encode version info", http.StatusInternalServerError)
 		}
 	}
 }
+
+// ConfigHandler returns the outcome of configuration reloads as JSON
+func ConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("ConfigHandler")
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reload.CurrentStatus()); err != nil {
+			logger.Printf("Failed to encode config status to JSON: %v", err)
+			http.Error(w, "Failed to encode config status", http.StatusInternalServerError)
+		}
+	}
+}
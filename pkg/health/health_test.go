@@ -0,0 +1,171 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// relay makes the given clusters relayed with cfg in effect
+func relay(t *testing.T, cfg config.Config, ids ...string) {
+	t.Helper()
+	previous := config.Current()
+	for _, id := range ids {
+		cfg.Clusters = append(cfg.Clusters, config.ClusterTarget{ID: id, Name: "name-" + id})
+	}
+	config.Set(cfg)
+	cluster.Default.LoadFromConfig(cfg)
+	t.Cleanup(func() {
+		config.Set(previous)
+		cluster.Default.LoadFromConfig(previous)
+	})
+}
+
+// setChecks replaces the results of the prober with the health of each check
+func setChecks(t *testing.T, healthy map[checkKey]bool) {
+	t.Helper()
+	checks := make(map[checkKey]*check, len(healthy))
+	for key, ok := range healthy {
+		state := CheckState{Checked: true, Healthy: ok}
+		if !ok {
+			state.Last.Err = errors.New("returned status: 503")
+		}
+		checks[key] = &check{state: state}
+	}
+	probes.mu.Lock()
+	probes.checks = checks
+	probes.mu.Unlock()
+	t.Cleanup(func() {
+		probes.mu.Lock()
+		probes.checks = make(map[checkKey]*check)
+		probes.mu.Unlock()
+	})
+}
+
+// prometheusOnly relays Prometheus alone
+func prometheusOnly() config.Config {
+	return config.Config{PrometheusNamespace: "monitoring", PrometheusService: "prometheus", PrometheusPort: "9090", ReadyMinClusters: 1}
+}
+
+// serve returns the status and body of a request to handler
+func serve(handler http.HandlerFunc, target string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestReadyToleratesClusterFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		minClusters int
+		healthy     map[string]bool
+		target      string
+		want        int
+	}{
+		{"one cluster down", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready", http.StatusOK},
+		{"every cluster down", 1, map[string]bool{"c-1": false, "c-2": false}, "/ready", http.StatusServiceUnavailable},
+		{"below the minimum", 2, map[string]bool{"c-1": true, "c-2": false, "c-3": true}, "/ready", http.StatusOK},
+		{"above the minimum", 3, map[string]bool{"c-1": true, "c-2": false, "c-3": true}, "/ready", http.StatusServiceUnavailable},
+		{"minimum above the cluster count", 5, map[string]bool{"c-1": true, "c-2": true}, "/ready", http.StatusOK},
+		{"selected cluster down", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready?cluster=c-2", http.StatusServiceUnavailable},
+		{"selected cluster up", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready?cluster=c-1", http.StatusOK},
+		{"selected cluster by name", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready?cluster=name-c-1", http.StatusOK},
+		{"unknown cluster", 1, map[string]bool{"c-1": true}, "/ready?cluster=c-9", http.StatusServiceUnavailable},
+		{"cluster path down", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready/c-2", http.StatusServiceUnavailable},
+		{"cluster path by name", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready/name-c-1", http.StatusOK},
+		{"service in enough clusters", 1, map[string]bool{"c-1": true, "c-2": false}, "/ready/prometheus", http.StatusOK},
+		{"unknown name", 1, map[string]bool{"c-1": true}, "/ready/c-9", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := prometheusOnly()
+			cfg.ReadyMinClusters = tt.minClusters
+			var ids []string
+			checks := map[checkKey]bool{}
+			for id, ok := range tt.healthy {
+				ids = append(ids, id)
+				checks[checkKey{cluster: id, service: config.PrometheusUpstream}] = ok
+			}
+			relay(t, cfg, ids...)
+			setChecks(t, checks)
+
+			handler := ReadyzHandler()
+			if strings.HasPrefix(tt.target, "/ready/") {
+				handler = ServiceReadyzHandler()
+			}
+			got, body := serve(handler, tt.target)
+			if got != tt.want {
+				t.Errorf("GET %s = %d, want %d\n%s", tt.target, got, tt.want, body)
+			}
+			// Clusters that are not ready are listed either way
+			for id, ok := range tt.healthy {
+				if !ok && tt.target == "/ready" && !strings.Contains(body, "cluster "+id+" (name-"+id+"): ") {
+					t.Errorf("cluster %s is not listed:\n%s", id, body)
+				}
+			}
+		})
+	}
+}
+
+func TestReadinessPolicies(t *testing.T) {
+	cfg := prometheusOnly()
+	cfg.PrometheusReadiness = config.ReadinessCritical
+	cfg.LokiNamespace, cfg.LokiService, cfg.LokiPort = "logging", "loki", "3100"
+	cfg.LokiReadiness = config.ReadinessOptional
+	cfg.RemoteNamespace, cfg.RemoteService, cfg.RemotePort = "monitoring", "alertmanager", "9093"
+	cfg.RemoteReadiness = config.ReadinessIgnored
+
+	tests := []struct {
+		name     string
+		down     string
+		target   string
+		want     int
+		contains string
+		excludes string
+	}{
+		{"all healthy", "", "/ready", http.StatusOK, "cluster c-1 (name-c-1): ok", ""},
+		{"optional down warns", config.LokiUpstream, "/ready", http.StatusOK, "loki (optional): returned status: 503", ""},
+		{"ignored down is left out", "alertmanager", "/ready", http.StatusOK, "cluster c-1 (name-c-1): ok", "alertmanager"},
+		{"critical down fails", config.PrometheusUpstream, "/ready", http.StatusServiceUnavailable, "prometheus: returned status: 503", ""},
+		{"ignored down fails its own check", "alertmanager", "/ready/alertmanager", http.StatusServiceUnavailable, "alertmanager: returned status: 503", ""},
+		{"optional down fails its own check", config.LokiUpstream, "/ready/loki", http.StatusServiceUnavailable, "loki: returned status: 503", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay(t, cfg, "c-1")
+			checks := map[checkKey]bool{}
+			for _, service := range []string{config.PrometheusUpstream, config.LokiUpstream, "alertmanager"} {
+				checks[checkKey{cluster: "c-1", service: service}] = service != tt.down
+			}
+			setChecks(t, checks)
+
+			handler := ReadyzHandler()
+			if strings.HasPrefix(tt.target, "/ready/") {
+				handler = ServiceReadyzHandler()
+			}
+			got, body := serve(handler, tt.target)
+			if got != tt.want {
+				t.Errorf("GET %s = %d, want %d\n%s", tt.target, got, tt.want, body)
+			}
+			if !strings.Contains(body, tt.contains) {
+				t.Errorf("body does not mention %q:\n%s", tt.contains, body)
+			}
+			if tt.excludes != "" && strings.Contains(body, tt.excludes) {
+				t.Errorf("body mentions %q:\n%s", tt.excludes, body)
+			}
+
+			// /status reports every upstream, including ignored ones
+			_, status := serve(StatusHandler(), "/status")
+			if tt.down != "" && !strings.Contains(status, `"`+tt.down+`"`) {
+				t.Errorf("/status does not report %s:\n%s", tt.down, status)
+			}
+		})
+	}
+}
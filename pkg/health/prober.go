@@ -0,0 +1,297 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/proxy"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
+)
+
+// reconcileInterval is how often the set of checks is matched against the
+// relayed clusters and configured upstreams
+const reconcileInterval = 5 * time.Second
+
+// checkKey identifies a check. Rancher itself has neither cluster nor service;
+// the Kubernetes API of a cluster has no service.
+type checkKey struct {
+	cluster string
+	service string
+}
+
+// target is what a check requests
+type target struct {
+	// upstream selects the connection pool used for the request
+	upstream string
+	url      string
+}
+
+// Result is the outcome of a single probe
+type Result struct {
+	Time    time.Time
+	Latency time.Duration
+	// Status is the HTTP status of the response, or 0 if there was none
+	Status int
+	Err    error
+}
+
+// CheckState is the last result of a check and whether it is healthy after
+// applying the failure and success thresholds
+type CheckState struct {
+	URL                  string
+	Checked              bool
+	Healthy              bool
+	Last                 Result
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+}
+
+// problem describes why a check is not healthy, or returns nil if it is
+func (s CheckState) problem() error {
+	switch {
+	case !s.Checked:
+		return fmt.Errorf("not checked yet")
+	case s.Healthy:
+		return nil
+	case s.Last.Err != nil:
+		return s.Last.Err
+	default:
+		return fmt.Errorf("recovering, %d successful check(s) in a row", s.ConsecutiveSuccesses)
+	}
+}
+
+// check is a running check
+type check struct {
+	target target
+	state  CheckState
+	cancel context.CancelFunc
+}
+
+// prober checks Rancher, the Kubernetes API of every relayed cluster and every
+// upstream in every cluster in the background and keeps the results
+type prober struct {
+	mu     sync.RWMutex
+	checks map[checkKey]*check
+}
+
+// probes holds the results served by /health and /ready
+var probes = &prober{checks: make(map[checkKey]*check)}
+
+// StartProber checks every target right away and then on the configured
+// interval until ctx is cancelled. Clusters and upstreams added or removed
+// later are picked up within a few seconds.
+func StartProber(ctx context.Context) {
+	probes.reconcile(ctx)
+	go func() {
+		ticker := time.NewTicker(reconcileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				probes.reconcile(ctx)
+			}
+		}
+	}()
+}
+
+// targets returns every check wanted for the current configuration and clusters
+func targets() map[checkKey]target {
+	cfg := config.Current()
+	wanted := map[checkKey]target{
+		{}: {upstream: transport.RancherUpstream, url: proxy.RancherCheckURL()},
+	}
+	for _, c := range cluster.Default.List() {
+		wanted[checkKey{cluster: c.ID}] = target{upstream: transport.RancherUpstream, url: proxy.BuildClusterAPIURL(c.ID) + "/version"}
+		for _, u := range cfg.Upstreams() {
+			wanted[checkKey{cluster: c.ID, service: u.Name}] = target{upstream: u.Name, url: proxy.UpstreamHealthURL(c.ID, u)}
+		}
+	}
+	return wanted
+}
+
+// reconcile starts checks for new targets, restarts those whose URL changed
+// and stops the ones no longer wanted
+func (p *prober) reconcile(ctx context.Context) {
+	wanted := targets()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, chk := range p.checks {
+		if t, ok := wanted[key]; !ok || t != chk.target {
+			chk.cancel()
+			delete(p.checks, key)
+		}
+	}
+	for key, t := range wanted {
+		if _, ok := p.checks[key]; ok {
+			continue
+		}
+		checkCtx, cancel := context.WithCancel(ctx)
+		chk := &check{target: t, state: CheckState{URL: t.url}, cancel: cancel}
+		p.checks[key] = chk
+		go p.run(checkCtx, key, chk)
+	}
+}
+
+// run probes a target until ctx is cancelled. The interval is varied by up to
+// 10% so that the checks of many clusters do not hit Rancher at the same time.
+func (p *prober) run(ctx context.Context, key checkKey, chk *check) {
+	for {
+		result := probe(ctx, chk.target)
+		if ctx.Err() != nil {
+			return
+		}
+		p.record(key, chk, result)
+
+		interval := config.Current().HealthProbeInterval
+		jitter := time.Duration(rand.Int63n(int64(interval)/5+1)) - interval/10
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + jitter):
+		}
+	}
+}
+
+// record applies a result to the state of a check
+func (p *prober) record(key checkKey, chk *check, result Result) {
+	cfg := config.Current()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &chk.state
+	s.Last = result
+	if result.Err == nil {
+		s.ConsecutiveSuccesses++
+		s.ConsecutiveFailures = 0
+	} else {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+	}
+
+	// The first result decides the initial state; later changes need the thresholds
+	healthy := s.Healthy
+	switch {
+	case !s.Checked:
+		healthy = result.Err == nil
+	case s.Healthy && s.ConsecutiveFailures >= cfg.HealthFailureThreshold:
+		healthy = false
+	case !s.Healthy && s.ConsecutiveSuccesses >= cfg.HealthSuccessThreshold:
+		healthy = true
+	}
+	switch {
+	case s.Checked && healthy == s.Healthy:
+		if healthy && result.Err != nil {
+			logger.Printf("Health check: %s failed %d of %d time(s): %v", key, s.ConsecutiveFailures, cfg.HealthFailureThreshold, result.Err)
+		}
+	case healthy:
+		logger.Printf("Health check: %s is healthy", key)
+	default:
+		logger.Printf("Health check: %s is unhealthy: %v", key, result.Err)
+	}
+	s.Checked = true
+	s.Healthy = healthy
+}
+
+// state returns the state of a check
+func (p *prober) state(key checkKey) CheckState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if chk, ok := p.checks[key]; ok {
+		return chk.state
+	}
+	return CheckState{}
+}
+
+// String names the check in logs
+func (k checkKey) String() string {
+	switch {
+	case k.cluster == "":
+		return "Rancher API"
+	case k.service == "":
+		return fmt.Sprintf("Kubernetes API of cluster %s", k.cluster)
+	default:
+		return fmt.Sprintf("%s in cluster %s", k.service, k.cluster)
+	}
+}
+
+// probe performs an authenticated GET against a target and expects a 200
+func probe(ctx context.Context, t target) Result {
+	timeout := config.Current().HealthProbeTimeout
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := Result{Time: start}
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url, http.NoBody)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create request: %v", err)
+		return result
+	}
+
+	resp, err := transport.NewClient(t.upstream, timeout).Do(req)
+	result.Latency = time.Since(start)
+	if err != nil {
+		// The URL is part of the check's state; keep only the cause
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		result.Err = fmt.Errorf("failed to connect: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		result.Err = fmt.Errorf("returned status: %d", resp.StatusCode)
+	}
+	return result
+}
+
+// readinessProblems returns the problems of the upstreams of a cluster
+// according to their readiness policy: critical upstreams fail /ready, optional
+// ones are only warned about and ignored ones are left out
+func readinessProblems(c cluster.Cluster) (errs, warnings []error) {
+	for _, u := range config.Current().Upstreams() {
+		err := probes.state(checkKey{cluster: c.ID, service: u.Name}).problem()
+		if err == nil {
+			continue
+		}
+		switch u.ReadinessPolicy() {
+		case config.ReadinessCritical:
+			errs = append(errs, fmt.Errorf("%s: %v", u.Name, err))
+		case config.ReadinessOptional:
+			warnings = append(warnings, fmt.Errorf("%s (optional): %v", u.Name, err))
+		}
+	}
+	return errs, warnings
+}
+
+// serviceProblems returns a function reporting the problem of one upstream in a cluster
+func serviceProblems(name string) func(cluster.Cluster) ([]error, []error) {
+	return func(c cluster.Cluster) ([]error, []error) {
+		if err := probes.state(checkKey{cluster: c.ID, service: name}).problem(); err != nil {
+			return []error{fmt.Errorf("%s: %v", name, err)}, nil
+		}
+		return nil, nil
+	}
+}
+
+// clusterAPIProblems returns the problem of the Kubernetes API of a cluster
+func clusterAPIProblems(c cluster.Cluster) ([]error, []error) {
+	if err := probes.state(checkKey{cluster: c.ID}).problem(); err != nil {
+		return []error{fmt.Errorf("kubernetes API: %v", err)}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,79 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestRecordAppliesThresholds(t *testing.T) {
+	defer config.Set(config.Current())
+	config.Set(config.Config{HealthFailureThreshold: 3, HealthSuccessThreshold: 2})
+
+	const (
+		ok   = true
+		fail = false
+	)
+	tests := []struct {
+		name    string
+		results []bool
+		healthy []bool
+	}{
+		{"first success", []bool{ok}, []bool{true}},
+		{"first failure", []bool{fail}, []bool{false}},
+		{"N-1 failures stay healthy", []bool{ok, fail, fail}, []bool{true, true, true}},
+		{"N failures flip", []bool{ok, fail, fail, fail}, []bool{true, true, true, false}},
+		{"a success resets the failures", []bool{ok, fail, fail, ok, fail, fail}, []bool{true, true, true, true, true, true}},
+		{"one success stays unhealthy", []bool{fail, ok}, []bool{false, false}},
+		{"success threshold flips back", []bool{ok, fail, fail, fail, ok, ok}, []bool{true, true, true, false, false, true}},
+		{"a failure resets the successes", []bool{fail, ok, fail, ok, ok}, []bool{false, false, false, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &prober{checks: make(map[checkKey]*check)}
+			key := checkKey{cluster: "c-1", service: config.PrometheusUpstream}
+			chk := &check{}
+			for i, success := range tt.results {
+				result := Result{Status: 200}
+				if !success {
+					result = Result{Status: 503, Err: errors.New("returned status: 503")}
+				}
+				p.record(key, chk, result)
+				if chk.state.Healthy != tt.healthy[i] {
+					t.Fatalf("after result %d healthy = %v, want %v (state %+v)", i+1, chk.state.Healthy, tt.healthy[i], chk.state)
+				}
+			}
+			if !chk.state.Checked {
+				t.Error("state is not marked as checked")
+			}
+		})
+	}
+}
+
+func TestRecordCountsConsecutiveResults(t *testing.T) {
+	defer config.Set(config.Current())
+	config.Set(config.Config{HealthFailureThreshold: 3, HealthSuccessThreshold: 2})
+
+	p := &prober{checks: make(map[checkKey]*check)}
+	chk := &check{}
+	failure := Result{Err: errors.New("failed to connect: connection refused")}
+	for i := 0; i < 2; i++ {
+		p.record(checkKey{}, chk, failure)
+	}
+	if s := chk.state; s.ConsecutiveFailures != 2 || s.ConsecutiveSuccesses != 0 || s.Last.Err != failure.Err {
+		t.Errorf("after two failures: %+v", s)
+	}
+	if err := chk.state.problem(); err != failure.Err {
+		t.Errorf("problem = %v, want the last error", err)
+	}
+
+	p.record(checkKey{}, chk, Result{Status: 200})
+	if s := chk.state; s.ConsecutiveFailures != 0 || s.ConsecutiveSuccesses != 1 || s.Healthy {
+		t.Errorf("after a success: %+v", s)
+	}
+	if err := chk.state.problem(); err == nil || err.Error() != "recovering, 1 successful check(s) in a row" {
+		t.Errorf("problem while recovering = %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// Verdicts of the status report
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+// Report is the JSON document served by /status. Ready is whether /ready would
+// succeed for the same clusters and ReadyClusters how many of them are ready.
+type Report struct {
+	Status        string          `json:"status"`
+	Ready         bool            `json:"ready"`
+	ReadyClusters int             `json:"readyClusters"`
+	Rancher       CheckReport     `json:"rancher"`
+	Clusters      []ClusterReport `json:"clusters"`
+}
+
+// ClusterReport is the state of the checks of one cluster. A cluster is
+// unavailable when a critical upstream fails and degraded when any other check
+// does. Ready is whether /ready/{cluster} would succeed, Problems and Warnings
+// are the failures it would report.
+type ClusterReport struct {
+	ID            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Status        string                 `json:"status"`
+	Ready         bool                   `json:"ready"`
+	Problems      []string               `json:"problems,omitempty"`
+	Warnings      []string               `json:"warnings,omitempty"`
+	KubernetesAPI CheckReport            `json:"kubernetesAPI"`
+	Upstreams     map[string]CheckReport `json:"upstreams"`
+}
+
+// CheckReport is the state of a single check. Readiness is set for upstreams only.
+type CheckReport struct {
+	URL                  string     `json:"url"`
+	Healthy              bool       `json:"healthy"`
+	Readiness            string     `json:"readiness,omitempty"`
+	LastCheck            *time.Time `json:"lastCheck,omitempty"`
+	LatencyMs            float64    `json:"latencyMs"`
+	HTTPStatus           int        `json:"httpStatus,omitempty"`
+	Error                string     `json:"error,omitempty"`
+	ConsecutiveFailures  int        `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int        `json:"consecutiveSuccesses"`
+}
+
+// StatusHandler returns an HTTP handler function that reports the last result
+// of every check as JSON, for all clusters or the one named by ?cluster=.
+// It answers 503 when Rancher is unhealthy or no cluster is relayed.
+func StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("StatusHandler")
+
+		report := buildReport(selectClusters(r), r.URL.Query().Get("cluster") == "")
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == StatusUnavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			logger.Printf("Failed to encode status report to JSON: %v", err)
+		}
+	}
+}
+
+// buildReport assembles the report for the given clusters; all is set when
+// every relayed cluster is reported rather than one selected by name
+func buildReport(clusters []cluster.Cluster, all bool) Report {
+	report := Report{
+		Status:   StatusOK,
+		Rancher:  checkReport(probes.state(checkKey{})),
+		Clusters: make([]ClusterReport, 0, len(clusters)),
+	}
+	results := checkClusters(clusters, readinessProblems)
+	report.ReadyClusters = readyClusters(results)
+	report.Ready = !shuttingDown.Load() && ready(results, all)
+
+	for _, result := range results {
+		cr := clusterReport(result)
+		if cr.Status != StatusOK {
+			report.Status = StatusDegraded
+		}
+		report.Clusters = append(report.Clusters, cr)
+	}
+	if !report.Rancher.Healthy || len(clusters) == 0 {
+		report.Status = StatusUnavailable
+	}
+	return report
+}
+
+// clusterReport returns the checks of a cluster, its readiness and its verdict
+func clusterReport(result clusterResult) ClusterReport {
+	c := result.cluster
+	cr := ClusterReport{
+		ID:            c.ID,
+		Name:          c.DisplayName(),
+		Ready:         len(result.errors) == 0,
+		KubernetesAPI: checkReport(probes.state(checkKey{cluster: c.ID})),
+		Upstreams:     make(map[string]CheckReport),
+	}
+	for _, err := range result.errors {
+		cr.Problems = append(cr.Problems, err.Error())
+	}
+	for _, err := range result.warnings {
+		cr.Warnings = append(cr.Warnings, err.Error())
+	}
+
+	criticalFailed, otherFailed := false, !cr.KubernetesAPI.Healthy
+	for _, u := range config.Current().Upstreams() {
+		check := checkReport(probes.state(checkKey{cluster: c.ID, service: u.Name}))
+		check.Readiness = u.ReadinessPolicy()
+		switch {
+		case check.Healthy:
+		case check.Readiness == config.ReadinessCritical:
+			criticalFailed = true
+		default:
+			otherFailed = true
+		}
+		cr.Upstreams[u.Name] = check
+	}
+
+	switch {
+	case criticalFailed:
+		cr.Status = StatusUnavailable
+	case otherFailed:
+		cr.Status = StatusDegraded
+	default:
+		cr.Status = StatusOK
+	}
+	return cr
+}
+
+// checkReport converts the state of a check
+func checkReport(s CheckState) CheckReport {
+	report := CheckReport{
+		URL:                  redactURL(s.URL),
+		Healthy:              s.Checked && s.Healthy,
+		ConsecutiveFailures:  s.ConsecutiveFailures,
+		ConsecutiveSuccesses: s.ConsecutiveSuccesses,
+	}
+	// A failure below the threshold is shown even though the check is still healthy
+	if s.Last.Err != nil {
+		report.Error = s.Last.Err.Error()
+	} else if err := s.problem(); err != nil {
+		report.Error = err.Error()
+	}
+	if s.Checked {
+		checked := s.Last.Time
+		report.LastCheck = &checked
+		report.LatencyMs = float64(s.Last.Latency.Microseconds()) / 1000
+		report.HTTPStatus = s.Last.Status
+	}
+	return report
+}
+
+// redactURL hides credentials in the user info and the query string of a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query.Set(key, "REDACTED")
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,194 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// clusterChecks returns healthy Rancher and Kubernetes API checks for the
+// clusters, with Prometheus healthy in the clusters listed in prometheus
+func clusterChecks(prometheus map[string]bool) map[checkKey]bool {
+	checks := map[checkKey]bool{{}: true}
+	for id, ok := range prometheus {
+		checks[checkKey{cluster: id}] = true
+		checks[checkKey{cluster: id, service: config.PrometheusUpstream}] = ok
+	}
+	return checks
+}
+
+// keys returns the sorted keys of a JSON object
+func keys(object map[string]interface{}) []string {
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStatusJSONShape(t *testing.T) {
+	relay(t, prometheusOnly(), "c-1", "c-2")
+	setChecks(t, clusterChecks(map[string]bool{"c-1": true, "c-2": false}))
+
+	server := httptest.NewServer(StatusHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var document map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys(document), []string{"clusters", "rancher", "ready", "readyClusters", "status"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("report fields = %v, want %v", got, want)
+	}
+
+	clusters, ok := document["clusters"].([]interface{})
+	if !ok || len(clusters) != 2 {
+		t.Fatalf("clusters = %v", document["clusters"])
+	}
+	healthy, failing := clusters[0].(map[string]interface{}), clusters[1].(map[string]interface{})
+	// Problems and warnings are left out when there are none
+	if got, want := keys(healthy), []string{"id", "kubernetesAPI", "name", "ready", "status", "upstreams"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("healthy cluster fields = %v, want %v", got, want)
+	}
+	if got, want := keys(failing), []string{"id", "kubernetesAPI", "name", "problems", "ready", "status", "upstreams"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failing cluster fields = %v, want %v", got, want)
+	}
+
+	upstreams := failing["upstreams"].(map[string]interface{})
+	check, ok := upstreams[config.PrometheusUpstream].(map[string]interface{})
+	if !ok {
+		t.Fatalf("upstreams = %v", upstreams)
+	}
+	want := []string{"consecutiveFailures", "consecutiveSuccesses", "error", "healthy", "lastCheck", "latencyMs", "readiness", "url"}
+	if got := keys(check); !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream check fields = %v, want %v", got, want)
+	}
+	if check["readiness"] != config.ReadinessCritical || check["healthy"] != false || check["error"] != "returned status: 503" {
+		t.Errorf("upstream check = %v", check)
+	}
+	// Readiness belongs to upstreams only
+	if _, ok := failing["kubernetesAPI"].(map[string]interface{})["readiness"]; ok {
+		t.Error("kubernetesAPI carries a readiness policy")
+	}
+}
+
+func TestStatusAggregation(t *testing.T) {
+	tests := []struct {
+		name         string
+		minClusters  int
+		prometheus   map[string]bool
+		rancherDown  bool
+		target       string
+		wantCode     int
+		wantStatus   string
+		wantReady    bool
+		wantReadyN   int
+		wantClusters map[string]string
+		wantProblems map[string][]string
+	}{
+		{
+			name: "all healthy", minClusters: 1, prometheus: map[string]bool{"c-1": true, "c-2": true}, target: "/status",
+			wantCode: http.StatusOK, wantStatus: StatusOK, wantReady: true, wantReadyN: 2,
+			wantClusters: map[string]string{"c-1": StatusOK, "c-2": StatusOK},
+		},
+		{
+			name: "one cluster down", minClusters: 1, prometheus: map[string]bool{"c-1": true, "c-2": false}, target: "/status",
+			wantCode: http.StatusOK, wantStatus: StatusDegraded, wantReady: true, wantReadyN: 1,
+			wantClusters: map[string]string{"c-1": StatusOK, "c-2": StatusUnavailable},
+			wantProblems: map[string][]string{"c-2": {"prometheus: returned status: 503"}},
+		},
+		{
+			name: "fewer ready than required", minClusters: 2, prometheus: map[string]bool{"c-1": true, "c-2": false}, target: "/status",
+			wantCode: http.StatusOK, wantStatus: StatusDegraded, wantReady: false, wantReadyN: 1,
+			wantClusters: map[string]string{"c-1": StatusOK, "c-2": StatusUnavailable},
+			wantProblems: map[string][]string{"c-2": {"prometheus: returned status: 503"}},
+		},
+		{
+			name: "every cluster down", minClusters: 1, prometheus: map[string]bool{"c-1": false, "c-2": false}, target: "/status",
+			wantCode: http.StatusOK, wantStatus: StatusDegraded, wantReady: false, wantReadyN: 0,
+			wantClusters: map[string]string{"c-1": StatusUnavailable, "c-2": StatusUnavailable},
+			wantProblems: map[string][]string{"c-1": {"prometheus: returned status: 503"}, "c-2": {"prometheus: returned status: 503"}},
+		},
+		{
+			name: "selected cluster down", minClusters: 1, prometheus: map[string]bool{"c-1": true, "c-2": false}, target: "/status?cluster=c-2",
+			wantCode: http.StatusOK, wantStatus: StatusDegraded, wantReady: false, wantReadyN: 0,
+			wantClusters: map[string]string{"c-2": StatusUnavailable},
+			wantProblems: map[string][]string{"c-2": {"prometheus: returned status: 503"}},
+		},
+		{
+			name: "rancher down", minClusters: 1, prometheus: map[string]bool{"c-1": true}, rancherDown: true, target: "/status",
+			wantCode: http.StatusServiceUnavailable, wantStatus: StatusUnavailable, wantReady: true, wantReadyN: 1,
+			wantClusters: map[string]string{"c-1": StatusOK},
+		},
+		{
+			name: "unknown cluster", minClusters: 1, prometheus: map[string]bool{"c-1": true}, target: "/status?cluster=c-9",
+			wantCode: http.StatusServiceUnavailable, wantStatus: StatusUnavailable, wantReady: false, wantReadyN: 0,
+			wantClusters: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := prometheusOnly()
+			cfg.ReadyMinClusters = tt.minClusters
+			var ids []string
+			for id := range tt.prometheus {
+				ids = append(ids, id)
+			}
+			relay(t, cfg, ids...)
+			checks := clusterChecks(tt.prometheus)
+			checks[checkKey{}] = !tt.rancherDown
+			setChecks(t, checks)
+
+			code, body := serve(StatusHandler(), tt.target)
+			if code != tt.wantCode {
+				t.Errorf("status code = %d, want %d", code, tt.wantCode)
+			}
+			var report Report
+			if err := json.Unmarshal([]byte(body), &report); err != nil {
+				t.Fatalf("%v\n%s", err, body)
+			}
+			if report.Status != tt.wantStatus || report.Ready != tt.wantReady || report.ReadyClusters != tt.wantReadyN {
+				t.Errorf("status %s, ready %v, readyClusters %d; want %s, %v, %d",
+					report.Status, report.Ready, report.ReadyClusters, tt.wantStatus, tt.wantReady, tt.wantReadyN)
+			}
+			if report.Rancher.Healthy == tt.rancherDown {
+				t.Errorf("rancher healthy = %v", report.Rancher.Healthy)
+			}
+
+			statuses := map[string]string{}
+			for _, cr := range report.Clusters {
+				statuses[cr.ID] = cr.Status
+				if cr.Ready != (len(tt.wantProblems[cr.ID]) == 0) {
+					t.Errorf("cluster %s ready = %v", cr.ID, cr.Ready)
+				}
+				if !reflect.DeepEqual(cr.Problems, tt.wantProblems[cr.ID]) {
+					t.Errorf("cluster %s problems = %q, want %q", cr.ID, cr.Problems, tt.wantProblems[cr.ID])
+				}
+			}
+			if !reflect.DeepEqual(statuses, tt.wantClusters) {
+				t.Errorf("cluster statuses = %v, want %v", statuses, tt.wantClusters)
+			}
+
+			// /ready agrees with the report
+			readyCode, _ := serve(ReadyzHandler(), "/ready"+tt.target[len("/status"):])
+			if (readyCode == http.StatusOK) != tt.wantReady {
+				t.Errorf("/ready = %d while the report says ready = %v", readyCode, tt.wantReady)
+			}
+		})
+	}
+}
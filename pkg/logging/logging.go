@@ -19,9 +19,8 @@ func LogFile() *logrus.Entry {
 	}
 	filename = filepath.Base(filename)
 
-	cfg := config.LoadConfigFromEnv()
 	// Check if the logger is in debug mode
-	if cfg.Debug {
+	if config.CFG.Debug {
 		logFilename := log.WithField("filename", filename).WithField("line", line)
 		return logFilename
 	}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
+)
+
+// connectionCollector exports the connection pool counters of every upstream
+type connectionCollector struct {
+	series []connectionSeries
+}
+
+// connectionSeries is one metric read from the pool counters
+type connectionSeries struct {
+	desc  *prometheus.Desc
+	kind  prometheus.ValueType
+	value func(*transport.ConnectionStats) float64
+}
+
+// newConnectionCollector returns the collector of the connection pool series
+func newConnectionCollector() *connectionCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{"upstream"}, nil)
+	}
+	return &connectionCollector{series: []connectionSeries{
+		{desc("upstream_connections_open", "Connections to Rancher currently open per upstream"), prometheus.GaugeValue,
+			func(s *transport.ConnectionStats) float64 { return float64(s.Open.Load()) }},
+		{desc("upstream_connections_dialed_total", "Connections to Rancher dialed per upstream"), prometheus.CounterValue,
+			func(s *transport.ConnectionStats) float64 { return float64(s.Dialed.Load()) }},
+		{desc("upstream_connections_reused_total", "Requests to Rancher served on a pooled connection per upstream"), prometheus.CounterValue,
+			func(s *transport.ConnectionStats) float64 { return float64(s.Reused.Load()) }},
+		{desc("upstream_tls_handshakes_total", "TLS handshakes with Rancher per upstream"), prometheus.CounterValue,
+			func(s *transport.ConnectionStats) float64 { return float64(s.TLSHandshakes.Load()) }},
+	}}
+}
+
+// Describe sends the descriptors of every series
+func (c *connectionCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.series {
+		ch <- s.desc
+	}
+}
+
+// Collect sends the current counters of every upstream
+func (c *connectionCollector) Collect(ch chan<- prometheus.Metric) {
+	for upstream, stats := range transport.Stats() {
+		for _, s := range c.series {
+			ch <- prometheus.MustNewConstMetric(s.desc, s.kind, s.value(stats), upstream)
+		}
+	}
+}
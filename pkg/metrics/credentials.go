@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/credentials"
+)
+
+var (
+	credentialInfoDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "credential_info"),
+		"Rancher authentication type in use", []string{"auth_type"}, nil)
+	credentialReloadsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "credential_reloads_total"),
+		"Credential reloads after a rotated file was detected", []string{"result"}, nil)
+	credentialLastReloadDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "credential_last_reload_timestamp_seconds"),
+		"Time of the last credential reload attempt", []string{"result"}, nil)
+)
+
+// credentialCollector exports the credential reload series
+type credentialCollector struct{}
+
+// Describe sends the descriptors of the credential series
+func (credentialCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- credentialInfoDesc
+	ch <- credentialReloadsDesc
+	ch <- credentialLastReloadDesc
+}
+
+// Collect sends the credential type and reload counters
+func (credentialCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := credentials.Stats
+	ch <- prometheus.MustNewConstMetric(credentialInfoDesc, prometheus.GaugeValue, 1, credentials.Current().Type)
+	ch <- prometheus.MustNewConstMetric(credentialReloadsDesc, prometheus.CounterValue, float64(stats.Successes.Load()), "success")
+	ch <- prometheus.MustNewConstMetric(credentialReloadsDesc, prometheus.CounterValue, float64(stats.Failures.Load()), "failure")
+	ch <- prometheus.MustNewConstMetric(credentialLastReloadDesc, prometheus.GaugeValue, float64(stats.LastSuccess.Load()), "success")
+	ch <- prometheus.MustNewConstMetric(credentialLastReloadDesc, prometheus.GaugeValue, float64(stats.LastFailure.Load()), "failure")
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Classes of upstream errors
+const (
+	ErrorClassDNS        = "dns"
+	ErrorClassTLS        = "tls"
+	ErrorClassTimeout    = "timeout"
+	ErrorClassConnection = "connection"
+	ErrorClass5xx        = "5xx"
+	ErrorClassOther      = "other"
+)
+
+// ClassifyError returns the class of an error from a request to Rancher
+func ClassifyError(err error) string {
+	var (
+		dnsErr      *net.DNSError
+		netErr      net.Error
+		opErr       *net.OpError
+		recordErr   tls.RecordHeaderError
+		verifyErr   *tls.CertificateVerificationError
+		authorityEr x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &verifyErr), errors.As(err, &authorityEr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr), strings.Contains(err.Error(), "tls: "):
+		return ErrorClassTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.As(err, &opErr):
+		return ErrorClassConnection
+	default:
+		return ErrorClassOther
+	}
+}
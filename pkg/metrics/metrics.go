@@ -1,45 +1,213 @@
 package metrics
 
 import (
-	"fmt"
 	"net/http"
+	"runtime"
+	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
 )
 
+// namespace prefixes every metric of the relay
+const namespace = "rancher_monitoring_relay"
+
 var (
 	logger    = logging.SetupLogging()
 	startTime = time.Now()
+
+	// registry holds the instrumented metrics and the collectors reading the
+	// state of other packages
+	registry = prometheus.NewRegistry()
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_info",
+		Help:      "Build information of the running relay",
+	}, []string{"version", "git_commit", "build_time", "goversion"})
+
+	proxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_requests_total",
+		Help:      "Requests proxied per cluster, service, method and status code",
+	}, []string{"cluster_id", "service", "method", "code"})
+
+	proxyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "proxy_request_duration_seconds",
+		Help:      "Time from receiving a proxied request until its response was sent, per cluster, service, method and status code",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"cluster_id", "service", "method", "code"})
+
+	proxyRequestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_request_bytes_total",
+		Help:      "Request body bytes received from clients per cluster, service and method",
+	}, []string{"cluster_id", "service", "method"})
+
+	proxyResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_response_bytes_total",
+		Help:      "Response body bytes sent to clients per cluster, service, method and status code",
+	}, []string{"cluster_id", "service", "method", "code"})
+
+	proxyInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "proxy_requests_in_flight",
+		Help:      "Proxied requests currently being served per cluster and service",
+	}, []string{"cluster_id", "service"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed requests to upstreams per cluster, service and error class (dns, tls, timeout, connection, 5xx, other)",
+	}, []string{"cluster_id", "service", "class"})
+
+	deniedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_denied_total",
+		Help:      "Requests refused by the access policy or tenant restrictions per cluster, service and method",
+	}, []string{"cluster_id", "service", "method"})
 )
 
-// MetricsHandler returns a simple metrics endpoint handler
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "uptime_seconds",
+			Help:      "Uptime of the service in seconds",
+		}, func() float64 { return time.Since(startTime).Seconds() }),
+		buildInfo,
+		proxyRequests,
+		proxyDuration,
+		proxyRequestBytes,
+		proxyResponseBytes,
+		proxyInFlight,
+		upstreamErrors,
+		deniedRequests,
+		clusterCollector{},
+		newConnectionCollector(),
+		credentialCollector{},
+		reloadCollector{},
+	)
+
+	// Series of clusters that are no longer relayed would be exported forever
+	cluster.Default.OnRemove(func(c cluster.Cluster) { forgetCluster(c.ID) })
+}
+
+// perCluster lists the metrics labelled with cluster_id
+var perCluster = []*prometheus.MetricVec{
+	proxyRequests.MetricVec,
+	proxyDuration.MetricVec,
+	proxyRequestBytes.MetricVec,
+	proxyResponseBytes.MetricVec,
+	proxyInFlight.MetricVec,
+	upstreamErrors.MetricVec,
+	deniedRequests.MetricVec,
+}
+
+// forgetCluster deletes every series of a cluster
+func forgetCluster(clusterID string) {
+	deleted := 0
+	for _, vec := range perCluster {
+		deleted += vec.DeletePartialMatch(prometheus.Labels{"cluster_id": clusterID})
+	}
+	if deleted > 0 {
+		logger.Printf("Deleted %d metric series of cluster %s", deleted, clusterID)
+	}
+}
+
+// SetBuildInfo publishes the version the relay was built from
+func SetBuildInfo(version, gitCommit, buildTime string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, gitCommit, buildTime, runtime.Version()).Set(1)
+}
+
+// ProxyRequest tracks a request proxied to a service in a cluster while it is served
+type ProxyRequest struct {
+	clusterID string
+	service   string
+	method    string
+	start     time.Time
+	// inFlight is kept so that a request outliving its cluster's series does
+	// not bring the gauge back below zero
+	inFlight prometheus.Gauge
+}
+
+// StartProxyRequest counts a proxied request as in flight until Done is called
+func StartProxyRequest(clusterID, service, method string) *ProxyRequest {
+	inFlight := proxyInFlight.WithLabelValues(clusterID, service)
+	inFlight.Inc()
+	return &ProxyRequest{clusterID: clusterID, service: service, method: normalizeMethod(method), start: time.Now(), inFlight: inFlight}
+}
+
+// Done records the outcome of the request
+func (p *ProxyRequest) Done(code int, requestBytes, responseBytes int64) {
+	status := strconv.Itoa(code)
+	p.inFlight.Dec()
+	proxyRequests.WithLabelValues(p.clusterID, p.service, p.method, status).Inc()
+	proxyDuration.WithLabelValues(p.clusterID, p.service, p.method, status).Observe(time.Since(p.start).Seconds())
+	proxyRequestBytes.WithLabelValues(p.clusterID, p.service, p.method).Add(float64(requestBytes))
+	proxyResponseBytes.WithLabelValues(p.clusterID, p.service, p.method, status).Add(float64(responseBytes))
+}
+
+// RecordUpstreamError counts a failed request to a service in a cluster
+func RecordUpstreamError(clusterID, service, class string) {
+	upstreamErrors.WithLabelValues(clusterID, service, class).Inc()
+}
+
+// RecordDeniedRequest counts a request refused by the access policy or tenant
+// restrictions of a service
+func RecordDeniedRequest(clusterID, service, method string) {
+	deniedRequests.WithLabelValues(clusterID, service, normalizeMethod(method)).Inc()
+}
+
+// normalizeMethod keeps the method label bounded: methods other than the
+// standard ones are counted as OTHER
+func normalizeMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// MetricsHandler returns the metrics endpoint handler. The exposition format
+// is negotiated with the scraper.
 func MetricsHandler() http.HandlerFunc {
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:          logger,
+		EnableOpenMetrics: true,
+		// Whatever could be gathered is still served
+		ErrorHandling: promhttp.ContinueOnError,
+	})
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("MetricsHandler")
-
-		// Basic metrics - can be extended with actual Prometheus metrics later
-		metrics := `# HELP rancher_monitoring_relay_info Information about the Rancher monitoring relay
-# TYPE rancher_monitoring_relay_info gauge
-rancher_monitoring_relay_info{version="0.1.0"} 1
-
-# HELP rancher_monitoring_relay_requests_total Total number of HTTP requests handled
-# TYPE rancher_monitoring_relay_requests_total counter
-rancher_monitoring_relay_requests_total{endpoint="/metrics"} 1
-
-# HELP rancher_monitoring_relay_uptime_seconds Uptime of the service in seconds
-# TYPE rancher_monitoring_relay_uptime_seconds gauge
-rancher_monitoring_relay_uptime_seconds ` + formatFloat(time.Since(startTime).Seconds()) + `
-`
-
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		if _, err := w.Write([]byte(metrics)); err != nil {
-			logger.Printf("Error writing metrics response: %v", err)
-		}
+		handler.ServeHTTP(w, r)
 	}
 }
 
-func formatFloat(f float64) string {
-	return fmt.Sprintf("%.2f", f)
+var clusterInfoDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cluster_info"),
+	"Clusters currently relayed by this process", []string{"cluster_id", "cluster_name"}, nil)
+
+// clusterCollector exports one series per relayed cluster
+type clusterCollector struct{}
+
+// Describe sends the descriptor of the cluster series
+func (clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clusterInfoDesc
+}
+
+// Collect sends the clusters currently relayed
+func (clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range cluster.Default.List() {
+		ch <- prometheus.MustNewConstMetric(clusterInfoDesc, prometheus.GaugeValue, 1, c.ID, c.Name)
+	}
 }
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestMetricsHandlerEscapesClusterNames(t *testing.T) {
+	cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{
+		{ID: "c-quote", Name: `team "a"\prod`},
+		{ID: "c-newline", Name: "line\nbreak"},
+		{ID: "c-utf8", Name: "équipe-日本"},
+	}})
+	t.Cleanup(func() { cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{}}) })
+
+	rec := httptest.NewRecorder()
+	MetricsHandler()(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("exposition does not parse: %v", err)
+	}
+	info, ok := families[namespace+"_cluster_info"]
+	if !ok {
+		t.Fatal("cluster_info is missing")
+	}
+	names := map[string]string{}
+	for _, m := range info.GetMetric() {
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		names[labels["cluster_id"]] = labels["cluster_name"]
+	}
+	for id, want := range map[string]string{"c-quote": `team "a"\prod`, "c-newline": "line\nbreak", "c-utf8": "équipe-日本"} {
+		if names[id] != want {
+			t.Errorf("cluster_name of %s = %q, want %q", id, names[id], want)
+		}
+	}
+	for _, name := range []string{"credential_info", "config_reloads_total"} {
+		if _, ok := families[namespace+"_"+name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+}
+
+func TestMetricsHandlerNegotiatesOpenMetrics(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	rec := httptest.NewRecorder()
+	MetricsHandler()(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q, want OpenMetrics", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Error("OpenMetrics exposition does not end with # EOF")
+	}
+}
+
+func TestRemovedClusterSeriesAreDeleted(t *testing.T) {
+	cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{{ID: "c-gone"}, {ID: "c-kept"}}})
+	t.Cleanup(func() { cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{}}) })
+
+	for _, id := range []string{"c-gone", "c-kept"} {
+		StartProxyRequest(id, "prometheus", http.MethodGet).Done(http.StatusOK, 10, 20)
+		RecordUpstreamError(id, "prometheus", ErrorClass5xx)
+		RecordDeniedRequest(id, "prometheus", http.MethodPost)
+	}
+	// A request still in flight when its cluster is removed
+	pending := StartProxyRequest("c-gone", "loki", http.MethodGet)
+
+	cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{{ID: "c-kept"}}})
+	pending.Done(http.StatusOK, 0, 0)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]bool{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch {
+			case labels["cluster_id"] == "c-kept":
+				kept[strings.TrimPrefix(family.GetName(), namespace+"_")] = true
+			case labels["cluster_id"] != "c-gone":
+			case labels["service"] == "loki":
+				// Counted when the pending request finished; its in-flight
+				// gauge was deleted and must not come back negative
+				if m.GetGauge() != nil {
+					t.Errorf("%s came back as %v", family.GetName(), m.GetGauge().GetValue())
+				}
+			default:
+				t.Errorf("%s still has a series of the removed cluster: %v", family.GetName(), labels)
+			}
+		}
+	}
+	for _, name := range []string{"proxy_requests_total", "proxy_request_duration_seconds", "proxy_request_bytes_total",
+		"proxy_response_bytes_total", "proxy_requests_in_flight", "upstream_errors_total", "requests_denied_total"} {
+		if !kept[name] {
+			t.Errorf("%s lost the series of the remaining cluster", name)
+		}
+	}
+}
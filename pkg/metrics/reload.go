@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/reload"
+)
+
+var (
+	configReloadsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "config_reloads_total"),
+		"Configuration reloads by result", []string{"result"}, nil)
+	configLastReloadSuccessfulDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "config_last_reload_successful"),
+		"Whether the last configuration reload succeeded", nil, nil)
+	configAppliedDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "config_applied_timestamp_seconds"),
+		"Time the configuration in effect was applied", nil, nil)
+	configRestartRequiredDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "config_restart_required"),
+		"Whether changed settings only take effect after a restart", nil, nil)
+)
+
+// reloadCollector exports the configuration reload series
+type reloadCollector struct{}
+
+// Describe sends the descriptors of the reload series
+func (reloadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- configReloadsDesc
+	ch <- configLastReloadSuccessfulDesc
+	ch <- configAppliedDesc
+	ch <- configRestartRequiredDesc
+}
+
+// Collect sends the reload status
+func (reloadCollector) Collect(ch chan<- prometheus.Metric) {
+	status := reload.CurrentStatus()
+
+	lastSuccessful := 1.0
+	if status.LastResult == reload.ResultFailure {
+		lastSuccessful = 0
+	}
+	restartRequired := 0.0
+	if len(status.RestartRequired) > 0 {
+		restartRequired = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, float64(status.Successes), reload.ResultSuccess)
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, float64(status.Failures), reload.ResultFailure)
+	ch <- prometheus.MustNewConstMetric(configLastReloadSuccessfulDesc, prometheus.GaugeValue, lastSuccessful)
+	ch <- prometheus.MustNewConstMetric(configAppliedDesc, prometheus.GaugeValue, float64(status.AppliedAt.Unix()))
+	ch <- prometheus.MustNewConstMetric(configRestartRequiredDesc, prometheus.GaugeValue, restartRequired)
+}
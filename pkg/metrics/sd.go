@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// TargetGroup is a single entry of the Prometheus http_sd_config response
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServiceDiscoveryHandler returns a Prometheus HTTP service discovery endpoint that lists
+// one target group per relayed cluster and service. The optional ?cluster= and ?service=
+// query parameters restrict the result, e.g. to give each service its own scrape job.
+// Prometheus targets scrape the series of the cluster through /federate; every
+// other upstream is scraped on its own /metrics.
+func ServiceDiscoveryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("ServiceDiscoveryHandler")
+
+		cfg := config.Current()
+		host := cfg.SDTargetHost
+		if host == "" {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+		}
+
+		scheme := "http"
+		if cfg.ListenerTLSCertFile != "" {
+			scheme = "https"
+		}
+
+		clusterFilter := r.URL.Query().Get("cluster")
+		serviceFilter := r.URL.Query().Get("service")
+
+		groups := []TargetGroup{}
+		for _, c := range cluster.Default.List() {
+			if clusterFilter != "" && clusterFilter != c.ID && clusterFilter != c.Name {
+				continue
+			}
+			for _, u := range cfg.Upstreams() {
+				if serviceFilter != "" && serviceFilter != u.Name {
+					continue
+				}
+				// Upstreams without a listener of their own are served under a path of the metrics port
+				port, prefix := u.ListenPort, ""
+				switch {
+				case cfg.SinglePort:
+					port, prefix = cfg.MetricsPort, u.RouterPath()
+				case port == "":
+					port, prefix = cfg.MetricsPort, strings.TrimSuffix(u.PathPrefix, "/")
+				}
+				// Unix sockets cannot be scraped over the network
+				if port = config.ListenPort(port); port == "" {
+					continue
+				}
+				labels := map[string]string{
+					"__scheme__":         scheme,
+					"__metrics_path__":   prefix + "/clusters/" + c.ID + "/metrics",
+					"cluster_id":         c.ID,
+					"cluster_name":       c.DisplayName(),
+					"service":            u.Name,
+					"namespace":          u.Namespace,
+					"kubernetes_service": u.Service,
+				}
+				if u.Name == config.PrometheusUpstream {
+					labels["__metrics_path__"] = prefix + "/clusters/" + c.ID + "/federate"
+					labels["__param_match[]"] = cfg.SDFederateMatch
+				}
+				groups = append(groups, TargetGroup{
+					Targets: []string{net.JoinHostPort(host, port)},
+					Labels:  labels,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			logger.Printf("Failed to encode service discovery response: %v", err)
+			http.Error(w, "Failed to encode service discovery response", http.StatusInternalServerError)
+		}
+	}
+}
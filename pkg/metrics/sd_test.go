@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestServiceDiscoveryTargetGroups(t *testing.T) {
+	base := config.Config{
+		MetricsPort:          "9000",
+		PrometheusNamespace:  "cattle-monitoring-system",
+		PrometheusService:    "rancher-monitoring-prometheus",
+		PrometheusPort:       "9090",
+		PrometheusListenPort: "9090",
+		LokiNamespace:        "cattle-logging-system",
+		LokiService:          "rancher-logging-loki",
+		LokiPort:             "3100",
+		LokiListenPort:       "3100",
+		SDTargetHost:         "relay.monitoring.svc",
+		SDFederateMatch:      `{job=~".+"}`,
+		Clusters:             []config.ClusterTarget{{ID: "c-m-abc123", Name: "production-west"}},
+	}
+	singlePort := base
+	singlePort.SinglePort = true
+
+	prometheusLabels := func(port, path string) TargetGroup {
+		return TargetGroup{
+			Targets: []string{"relay.monitoring.svc:" + port},
+			Labels: map[string]string{
+				"__scheme__":         "http",
+				"__metrics_path__":   path,
+				"__param_match[]":    `{job=~".+"}`,
+				"cluster_id":         "c-m-abc123",
+				"cluster_name":       "production-west",
+				"service":            "prometheus",
+				"namespace":          "cattle-monitoring-system",
+				"kubernetes_service": "rancher-monitoring-prometheus",
+			},
+		}
+	}
+	lokiLabels := func(port, path string) TargetGroup {
+		return TargetGroup{
+			Targets: []string{"relay.monitoring.svc:" + port},
+			Labels: map[string]string{
+				"__scheme__":         "http",
+				"__metrics_path__":   path,
+				"cluster_id":         "c-m-abc123",
+				"cluster_name":       "production-west",
+				"service":            "loki",
+				"namespace":          "cattle-logging-system",
+				"kubernetes_service": "rancher-logging-loki",
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		query string
+		want  []TargetGroup
+	}{
+		{
+			name: "own listeners",
+			cfg:  base,
+			want: []TargetGroup{
+				prometheusLabels("9090", "/clusters/c-m-abc123/federate"),
+				lokiLabels("3100", "/clusters/c-m-abc123/metrics"),
+			},
+		},
+		{
+			name: "single port",
+			cfg:  singlePort,
+			want: []TargetGroup{
+				prometheusLabels("9000", "/prometheus/clusters/c-m-abc123/federate"),
+				lokiLabels("9000", "/loki/clusters/c-m-abc123/metrics"),
+			},
+		},
+		{
+			name:  "service filter",
+			cfg:   base,
+			query: "?service=loki",
+			want:  []TargetGroup{lokiLabels("3100", "/clusters/c-m-abc123/metrics")},
+		},
+		{
+			name:  "unknown cluster",
+			cfg:   base,
+			query: "?cluster=c-other",
+			want:  []TargetGroup{},
+		},
+	}
+
+	defer config.Set(config.Current())
+	defer cluster.Default.LoadFromConfig(config.Config{Clusters: []config.ClusterTarget{}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Set(tt.cfg)
+			cluster.Default.LoadFromConfig(tt.cfg)
+
+			rec := httptest.NewRecorder()
+			ServiceDiscoveryHandler()(rec, httptest.NewRequest(http.MethodGet, "/sd/prometheus"+tt.query, nil))
+
+			var got []TargetGroup
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("target groups\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// accessRule is a config.AccessRule with its path pattern compiled
+type accessRule struct {
+	methods []string
+	path    *regexp.Regexp
+}
+
+// accessControl decides which requests may be relayed to an upstream
+type accessControl struct {
+	allow []accessRule
+	deny  []accessRule
+}
+
+// newAccessControl compiles the rules of an access policy
+func newAccessControl(p config.AccessPolicy) accessControl {
+	allow, deny := p.Rules()
+	return accessControl{allow: compileRules(allow), deny: compileRules(deny)}
+}
+
+// compileRules compiles the path pattern of every rule
+func compileRules(rules []config.AccessRule) []accessRule {
+	compiled := make([]accessRule, 0, len(rules))
+	for _, rule := range rules {
+		compiled = append(compiled, accessRule{methods: rule.Methods, path: globPattern(rule.Path)})
+	}
+	return compiled
+}
+
+// globPattern converts a path pattern to a regular expression: "*" matches
+// within one segment, "**" across segments and a trailing "/**" also matches
+// the bare prefix
+func globPattern(pattern string) *regexp.Regexp {
+	suffix := ""
+	if strings.HasSuffix(pattern, "/**") {
+		pattern = strings.TrimSuffix(pattern, "/**")
+		suffix = "(/.*)?"
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString(suffix + "$")
+	return regexp.MustCompile(b.String())
+}
+
+// matches reports whether the rule applies to a request
+func (r accessRule) matches(method, path string) bool {
+	if len(r.methods) > 0 {
+		found := false
+		for _, m := range r.methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// A trailing slash usually reaches the same handler, so it must not slip past a rule
+	return r.path.MatchString(path) || (path != "/" && r.path.MatchString(strings.TrimSuffix(path, "/")))
+}
+
+// allowed reports whether a request for the cleaned upstream path may be relayed
+func (a accessControl) allowed(method, path string) bool {
+	for _, rule := range a.deny {
+		if rule.matches(method, path) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, rule := range a.allow {
+		if rule.matches(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath resolves "." and ".." segments and duplicate slashes so that rules
+// see the path the upstream will serve, keeping any trailing slash
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
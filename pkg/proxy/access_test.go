@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/api/v1/query", "/api/v1/query", true},
+		{"/api/v1/query", "/api/v1/query_range", false},
+		{"/api/v1/*", "/api/v1/query", true},
+		{"/api/v1/*", "/api/v1/admin/tsdb", false},
+		{"/api/v1/label/*/values", "/api/v1/label/job/values", true},
+		{"/api/v1/label/*/values", "/api/v1/label/a/b/values", false},
+		{"/api/v1/**", "/api/v1/admin/tsdb/snapshot", true},
+		{"/api/v1/admin/**", "/api/v1/admin", true},
+		{"/api/v1/admin/**", "/api/v1/administrator", false},
+		{"/api/**/values", "/api/v1/label/job/values", true},
+		{"/loki/api/v1/index/*", "/loki/api/v1/index/stats", true},
+		{"/metrics.json", "/metricsXjson", false},
+		{"/**", "/", true},
+	}
+
+	for _, tt := range tests {
+		if got := globPattern(tt.pattern).MatchString(tt.path); got != tt.want {
+			t.Errorf("pattern %s matches %s = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAccessControlAllowed(t *testing.T) {
+	custom := config.AccessPolicy{
+		Allow: []config.AccessRule{
+			{Methods: []string{"GET"}, Path: "/api/v1/invoices/**"},
+			{Methods: []string{"post", "PUT"}, Path: "/api/v1/invoices/*/notes"},
+		},
+		Deny: []config.AccessRule{
+			{Path: "/api/v1/invoices/*/raw"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		policy config.AccessPolicy
+		method string
+		path   string
+		want   bool
+	}{
+		{"no rules", config.AccessPolicy{}, "DELETE", "/anything", true},
+		{"allowed method", custom, "GET", "/api/v1/invoices/42", true},
+		{"method not listed", custom, "DELETE", "/api/v1/invoices/42", false},
+		{"methods are case insensitive", custom, "POST", "/api/v1/invoices/42/notes", true},
+		{"second method of a list", custom, "PUT", "/api/v1/invoices/42/notes", true},
+		{"path not allowed", custom, "GET", "/api/v1/customers", false},
+		{"deny over allow", custom, "GET", "/api/v1/invoices/42/raw", false},
+		{"deny with a trailing slash", custom, "GET", "/api/v1/invoices/42/raw/", false},
+		{"allow with a trailing slash", custom, "GET", "/api/v1/invoices/", true},
+		{"deny after resolving ..", custom, "GET", "/api/v1/invoices/42/notes/../raw", false},
+		{"allow after resolving ..", custom, "GET", "/api/v1/customers/../invoices/42", true},
+		{"escape via .. refused", custom, "GET", "/api/v1/invoices/../customers", false},
+		{"duplicate slashes", custom, "GET", "//api/v1//invoices/42/raw", false},
+		{"readonly query", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "POST", "/api/v1/query", true},
+		{"readonly remote write", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "POST", "/api/v1/write", false},
+		{"readonly admin", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "GET", "/api/v1/admin/tsdb/snapshot", false},
+		{"readonly admin prefix", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "GET", "/api/v1/admin", false},
+		{"readonly reload with a trailing slash", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "POST", "/-/reload/", false},
+		{"readonly admin via ..", config.AccessPolicy{Profile: config.PrometheusReadOnlyProfile}, "GET", "/api/v1/query/../admin/tsdb/snapshot", false},
+		{"push only", config.AccessPolicy{Profile: config.LokiPushOnlyProfile}, "POST", "/loki/api/v1/push", true},
+		{"push only query", config.AccessPolicy{Profile: config.LokiPushOnlyProfile}, "GET", "/loki/api/v1/query", false},
+		{"loki readonly push", config.AccessPolicy{Profile: config.LokiReadOnlyProfile}, "POST", "/loki/api/v1/push", false},
+		{
+			"profile extended by own rules",
+			config.AccessPolicy{Profile: config.LokiReadOnlyProfile, Deny: []config.AccessRule{{Path: "/loki/api/v1/tail"}}},
+			"GET", "/loki/api/v1/tail", false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newAccessControl(tt.policy).allowed(tt.method, cleanPath(tt.path)); got != tt.want {
+				t.Errorf("%s %s allowed = %v, want %v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
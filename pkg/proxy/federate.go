@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+)
+
+const (
+	federatePath = "/federate"
+
+	// Labels added to every federated series
+	clusterIDLabel   = "cluster_id"
+	clusterNameLabel = "cluster_name"
+)
+
+// federationOptions returns proxy options that add cluster identity labels to
+// every series returned by the Prometheus /federate endpoint. Series that
+// already carry a label with the same name keep their value, matching how
+// Prometheus applies external_labels.
+func federationOptions() proxyOptions {
+	return proxyOptions{
+		director: func(proxyReq *http.Request, _ cluster.Cluster) {
+			if !isFederateRequest(proxyReq) {
+				return
+			}
+			// Only the line based formats can be rewritten, so never ask for protobuf
+			if strings.Contains(proxyReq.Header.Get("Accept"), "application/openmetrics-text") {
+				proxyReq.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+			} else {
+				proxyReq.Header.Set("Accept", "text/plain;version=0.0.4")
+			}
+			// Let the transport handle compression so the body arrives decoded
+			proxyReq.Header.Del("Accept-Encoding")
+		},
+		modifyResponse: func(resp *http.Response, c cluster.Cluster) error {
+			if !isFederateRequest(resp.Request) || resp.StatusCode != http.StatusOK {
+				return nil
+			}
+
+			labels := []labelPair{
+				{name: clusterIDLabel, value: c.ID},
+				{name: clusterNameLabel, value: c.DisplayName()},
+			}
+
+			reader, writer := io.Pipe()
+			go func(body io.ReadCloser) {
+				defer body.Close()
+				writer.CloseWithError(injectExpositionLabels(body, writer, labels))
+			}(resp.Body)
+
+			resp.Body = reader
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			return nil
+		},
+	}
+}
+
+// isFederateRequest reports whether a proxied request targets the Prometheus /federate endpoint
+func isFederateRequest(r *http.Request) bool {
+	return r != nil && strings.HasSuffix(r.URL.Path, "/proxy"+federatePath)
+}
+
+// labelPair is a label name and value to inject into exposition lines
+type labelPair struct {
+	name  string
+	value string
+}
+
+// injectExpositionLabels copies Prometheus text or OpenMetrics exposition from
+// src to dst, adding labels to every sample line. Comment, HELP, TYPE and EOF
+// lines are passed through unchanged.
+func injectExpositionLabels(src io.Reader, dst io.Writer, labels []labelPair) error {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	out := bufio.NewWriter(dst)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && line[0] != '#' {
+			line = injectSampleLabels(line, labels)
+		}
+		if _, err := out.WriteString(line); err != nil {
+			return err
+		}
+		if err := out.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// injectSampleLabels adds the labels missing from a single sample line such as
+// `http_requests_total{code="200"} 1027 1395066363000`
+func injectSampleLabels(line string, labels []labelPair) string {
+	open := strings.IndexAny(line, "{ \t")
+	if open < 0 {
+		return line
+	}
+
+	if line[open] != '{' {
+		// Sample without labels: name value [timestamp]
+		return line[:open] + "{" + formatLabels(labels, nil) + "}" + line[open:]
+	}
+
+	end := findLabelSetEnd(line, open)
+	if end < 0 {
+		return line
+	}
+
+	existing := labelNames(line[open+1 : end])
+	added := formatLabels(labels, existing)
+	if added == "" {
+		return line
+	}
+
+	inner := strings.TrimRight(line[open+1:end], " \t")
+	separator := ","
+	if inner == "" || strings.HasSuffix(inner, ",") {
+		separator = ""
+	}
+	return line[:open+1] + inner + separator + added + line[end:]
+}
+
+// findLabelSetEnd returns the index of the '}' closing the label set opened at
+// index open, skipping over quoted label values and names
+func findLabelSetEnd(line string, open int) int {
+	inQuotes := false
+	for i := open + 1; i < len(line); i++ {
+		switch {
+		case inQuotes && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && line[i] == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// labelNames returns the label names present in the body of a label set
+func labelNames(labelSet string) map[string]bool {
+	names := make(map[string]bool)
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(labelSet); i++ {
+		switch {
+		case inQuotes && labelSet[i] == '\\':
+			i++
+		case labelSet[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && labelSet[i] == ',':
+			start = i + 1
+		case !inQuotes && labelSet[i] == '=':
+			name := strings.Trim(strings.TrimSpace(labelSet[start:i]), `"`)
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// formatLabels renders the labels not present in existing as name="value" pairs
+func formatLabels(labels []labelPair, existing map[string]bool) string {
+	var parts []string
+	for _, label := range labels {
+		if existing[label.name] {
+			continue
+		}
+		parts = append(parts, label.name+`="`+escapeLabelValue(label.value)+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// escapeLabelValue escapes a label value for the exposition formats
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var testLabels = []labelPair{{name: "cluster_id", value: "c-1"}, {name: "cluster_name", value: `prod "west"`}}
+
+func TestInjectSampleLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "no labels",
+			line: `up 1`,
+			want: `up{cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "no labels with timestamp",
+			line: "up\t1 1395066363000",
+			want: "up{cluster_id=\"c-1\",cluster_name=\"prod \\\"west\\\"\"}\t1 1395066363000",
+		},
+		{
+			name: "empty label set",
+			line: `up{} 1`,
+			want: `up{cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "labels",
+			line: `http_requests_total{code="200",method="get"} 1027 1395066363000`,
+			want: `http_requests_total{code="200",method="get",cluster_id="c-1",cluster_name="prod \"west\""} 1027 1395066363000`,
+		},
+		{
+			name: "trailing comma",
+			line: `up{job="node",} 1`,
+			want: `up{job="node",cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "escaped quote and brace in a value",
+			line: `msg{text="say \"hi\" }",job="x"} 1`,
+			want: `msg{text="say \"hi\" }",job="x",cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "equals sign and comma in a value",
+			line: `q{query="a=b,cluster_id=c"} 1`,
+			want: `q{query="a=b,cluster_id=c",cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "escaped backslash before the closing quote",
+			line: `path{dir="C:\\"} 1`,
+			want: `path{dir="C:\\",cluster_id="c-1",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "cluster_id already present",
+			line: `up{cluster_id="other",job="x"} 1`,
+			want: `up{cluster_id="other",job="x",cluster_name="prod \"west\""} 1`,
+		},
+		{
+			name: "both labels already present",
+			line: `up{cluster_name="b", cluster_id="a"} 1`,
+			want: `up{cluster_name="b", cluster_id="a"} 1`,
+		},
+		{
+			name: "exemplar",
+			line: `req_bucket{le="0.5"} 11 # {trace_id="abc"} 0.3 1520879607.789`,
+			want: `req_bucket{le="0.5",cluster_id="c-1",cluster_name="prod \"west\""} 11 # {trace_id="abc"} 0.3 1520879607.789`,
+		},
+		{
+			name: "exemplar without labels",
+			line: `req_count 11 # {trace_id="abc"} 1`,
+			want: `req_count{cluster_id="c-1",cluster_name="prod \"west\""} 11 # {trace_id="abc"} 1`,
+		},
+		{
+			name: "unterminated label set",
+			line: `up{job="x 1`,
+			want: `up{job="x 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := injectSampleLabels(tt.line, testLabels); got != tt.want {
+				t.Errorf("injectSampleLabels(%q)\n got %s\nwant %s", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectExpositionLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "text format",
+			input: `# HELP up Whether the target is up.
+# TYPE up gauge
+up{job="node"} 1 1700000000000
+# a comment with {braces}
+
+node_load1 0.5
+`,
+			want: `# HELP up Whether the target is up.
+# TYPE up gauge
+up{job="node",cluster_id="c-1",cluster_name="prod \"west\""} 1 1700000000000
+# a comment with {braces}
+
+node_load1{cluster_id="c-1",cluster_name="prod \"west\""} 0.5
+`,
+		},
+		{
+			name: "OpenMetrics",
+			input: `# TYPE req histogram
+# UNIT req seconds
+# HELP req Request latency.
+req_bucket{le="0.5"} 11 # {trace_id="abc"} 0.3
+req_bucket{le="+Inf"} 17
+req_count 17
+req_sum 3.2
+# EOF
+`,
+			want: `# TYPE req histogram
+# UNIT req seconds
+# HELP req Request latency.
+req_bucket{le="0.5",cluster_id="c-1",cluster_name="prod \"west\""} 11 # {trace_id="abc"} 0.3
+req_bucket{le="+Inf",cluster_id="c-1",cluster_name="prod \"west\""} 17
+req_count{cluster_id="c-1",cluster_name="prod \"west\""} 17
+req_sum{cluster_id="c-1",cluster_name="prod \"west\""} 3.2
+# EOF
+`,
+		},
+		{
+			name:  "empty body",
+			input: "",
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := injectExpositionLabels(strings.NewReader(tt.input), &out, testLabels); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -1,179 +1,270 @@
 package proxy
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strings"
-	"time"
 
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/auth"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
 	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/metrics"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/tenant"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/transport"
 )
 
 var logger = logging.SetupLogging()
 
-// BuildServiceProxyURL constructs a Rancher service proxy URL
-func BuildServiceProxyURL(namespace, service, port string) string {
-	return fmt.Sprintf("%s/k8s/clusters/%s/api/v1/namespaces/%s/services/%s:%s/proxy/",
-		config.CFG.RancherApiEndpoint,
-		config.CFG.ClusterId,
+// BuildClusterAPIURL returns the Kubernetes API URL of the given cluster. In
+// direct mode the endpoint is a Kubernetes API server and the cluster ID is unused.
+func BuildClusterAPIURL(clusterID string) string {
+	cfg := config.Current()
+	if cfg.DirectClusterAPI {
+		return strings.TrimSuffix(cfg.RancherApiEndpoint, "/")
+	}
+	return fmt.Sprintf("%s/k8s/clusters/%s", cfg.RancherApiEndpoint, clusterID)
+}
+
+// RancherCheckURL returns the URL requested to verify access to Rancher. In
+// direct mode the endpoint is a Kubernetes API server whose root is not readable
+// with the default RBAC, so its /version is requested instead.
+func RancherCheckURL() string {
+	cfg := config.Current()
+	if cfg.DirectClusterAPI {
+		return strings.TrimSuffix(cfg.RancherApiEndpoint, "/") + "/version"
+	}
+	return cfg.RancherApiEndpoint
+}
+
+// BuildServiceProxyURL constructs a Rancher service proxy URL for the given cluster
+func BuildServiceProxyURL(clusterID, namespace, service, port string) string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s:%s/proxy/",
+		BuildClusterAPIURL(clusterID),
 		namespace,
 		service,
 		port,
 	)
 }
 
-// BuildPrometheusURL returns the Prometheus service proxy URL
-func BuildPrometheusURL() string {
+// BuildPrometheusURL returns the Prometheus service proxy URL for the given cluster
+func BuildPrometheusURL(clusterID string) string {
+	cfg := config.Current()
 	return BuildServiceProxyURL(
-		config.CFG.PrometheusNamespace,
-		config.CFG.PrometheusService,
-		config.CFG.PrometheusPort,
+		clusterID,
+		cfg.PrometheusNamespace,
+		cfg.PrometheusService,
+		cfg.PrometheusPort,
 	)
 }
 
-// BuildLokiURL returns the Loki service proxy URL
-func BuildLokiURL() string {
+// BuildLokiURL returns the Loki service proxy URL for the given cluster
+func BuildLokiURL(clusterID string) string {
+	cfg := config.Current()
 	return BuildServiceProxyURL(
-		config.CFG.LokiNamespace,
-		config.CFG.LokiService,
-		config.CFG.LokiPort,
+		clusterID,
+		cfg.LokiNamespace,
+		cfg.LokiService,
+		cfg.LokiPort,
 	)
 }
 
-// TestServiceConnectivity tests if a service is reachable via Rancher proxy
-func TestServiceConnectivity(serviceURL, serviceName string) error {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.CFG.RancherInsecureSkipVerify,
-			},
-		},
+// BuildUpstreamURL returns the service proxy URL of an upstream in the given cluster
+func BuildUpstreamURL(clusterID string, u config.Upstream) string {
+	service := u.Service
+	if u.Scheme == "https" {
+		// The Kubernetes service proxy connects over TLS when the name carries the scheme
+		service = "https:" + service
 	}
+	return BuildServiceProxyURL(clusterID, u.Namespace, service, u.Port)
+}
 
-	// For Loki, test the /ready endpoint
-	testURL := serviceURL
-	if serviceName == "loki" {
-		testURL += "ready"
-	} else if serviceName == "prometheus" {
-		testURL += "-/ready"
+// UpstreamHealthURL returns the URL requested to check an upstream in the
+// given cluster: its health path, or its root when none is configured
+func UpstreamHealthURL(clusterID string, u config.Upstream) string {
+	healthURL := strings.TrimSuffix(BuildUpstreamURL(clusterID, u), "/") + u.HealthPath
+	if u.HealthPath == "" {
+		healthURL += "/"
 	}
-	// For echo-test, just use the root path (no health endpoint needed)
-
-	logger.Printf("Testing connectivity to %s at: %s", serviceName, testURL)
+	return healthURL
+}
 
-	req, err := http.NewRequest("GET", testURL, http.NoBody)
-	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
-	}
+// proxyOptions customizes how createProxyHandler forwards a request
+type proxyOptions struct {
+	// director, if set, adjusts the outgoing request before it is sent to Rancher
+	director func(proxyReq *http.Request, c cluster.Cluster)
+	// modifyResponse, if set, rewrites the upstream response before it is copied to the client
+	modifyResponse func(resp *http.Response, c cluster.Cluster) error
+	// prepare, if set, checks and rewrites the client request for the routed
+	// upstream path and cluster. A *tenant.Error sets the status of the refusal.
+	prepare func(r *http.Request, path string, c cluster.Cluster) error
+}
 
-	req.SetBasicAuth(config.CFG.RancherApiAccessKey, config.CFG.RancherApiSecretKey)
+// routeContextKey is the request context key holding the resolved route
+type routeContextKey struct{}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error connecting to %s: %v", serviceName, err)
-	}
-	defer resp.Body.Close()
+// route is the cluster a request was routed to and the path left after routing.
+// base is the client-facing path of the upstream root, including any mount and
+// cluster routing prefix.
+type route struct {
+	cluster cluster.Cluster
+	path    string
+	base    string
+}
 
-	logger.Printf("%s responded with status: %d", serviceName, resp.StatusCode)
+// requestRoute returns the route resolved for a proxied request
+func requestRoute(r *http.Request) route {
+	rt, _ := r.Context().Value(routeContextKey{}).(route)
+	return rt
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%s health check failed, status code: %d", serviceName, resp.StatusCode)
-	}
+// createProxyHandler creates an HTTP handler that proxies requests to the given
+// upstream in whichever cluster the request is routed to. Responses are streamed
+// back as they arrive, WebSocket upgrades (e.g. Loki tail) are passed through and
+// the upstream request is cancelled when the client goes away.
+func createProxyHandler(u config.Upstream, opts proxyOptions) http.HandlerFunc {
+	serviceName := u.Name
+	access := newAccessControl(u.Access)
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			rt := requestRoute(pr.In)
+			c := rt.cluster
 
-	logger.Printf("Successfully connected to %s service", serviceName)
-	return nil
-}
+			// Build target URL by combining service URL with the routed request path
+			target, err := url.Parse(BuildUpstreamURL(c.ID, u))
+			if err != nil {
+				logger.Printf("Error parsing service proxy URL for %s: %v", serviceName, err)
+				return
+			}
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.URL.Path = strings.TrimSuffix(target.Path, "/") + rt.path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = ""
 
-// createProxyHandler creates an HTTP handler that proxies requests to the specified service URL
-func createProxyHandler(serviceURL, serviceName string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Build target URL by combining service URL with the request path
-		targetURL := strings.TrimSuffix(serviceURL, "/") + r.URL.Path
-		if r.URL.RawQuery != "" {
-			targetURL += "?" + r.URL.RawQuery
-		}
+			// Keep X-Forwarded-For from upstream proxies and append the client address
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
 
-		logger.Printf("Proxying %s request to %s: %s", serviceName, r.Method, targetURL)
+			// Never forward client credentials; the transport authenticates with Rancher
+			pr.Out.Header.Del("Authorization")
 
-		// Create the proxy request
-		proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-		if err != nil {
-			logger.Printf("Error creating proxy request: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+			if opts.director != nil {
+				opts.director(pr.Out, c)
+			}
 
-		// Copy headers from original request
-		for name, values := range r.Header {
-			for _, value := range values {
-				proxyReq.Header.Add(name, value)
+			logger.Printf("Proxying %s request for cluster %s to %s: %s", serviceName, c.ID, pr.Out.Method, pr.Out.URL)
+		},
+		Transport: transport.For(serviceName),
+		// Flush every write so chunked and streaming responses reach the client immediately
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			rt := requestRoute(resp.Request)
+			c := rt.cluster
+			if resp.StatusCode >= 500 {
+				metrics.RecordUpstreamError(c.ID, serviceName, metrics.ErrorClass5xx)
 			}
-		}
 
-		// Set Rancher authentication
-		proxyReq.SetBasicAuth(config.CFG.RancherApiAccessKey, config.CFG.RancherApiSecretKey)
-
-		// Create HTTP client with timeout
-		client := &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: config.CFG.RancherInsecureSkipVerify,
-				},
-			},
-		}
+			// Redirects point at the service proxy path; send the client back through the relay
+			if location := resp.Header.Get("Location"); location != "" {
+				if target, err := url.Parse(BuildUpstreamURL(c.ID, u)); err == nil {
+					resp.Header.Set("Location", rewriteLocation(location, target, rt.base))
+				}
+			}
 
-		// Execute the proxy request
-		resp, err := client.Do(proxyReq)
-		if err != nil {
-			logger.Printf("Error executing proxy request to %s: %v", serviceName, err)
+			if opts.modifyResponse != nil {
+				return opts.modifyResponse(resp, c)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			c := requestRoute(r).cluster
+			if errors.Is(err, context.Canceled) {
+				logger.Printf("Client cancelled %s request for cluster %s: %s", serviceName, c.ID, r.URL.Path)
+				return
+			}
+			logger.Printf("Error executing proxy request to %s in cluster %s: %v", serviceName, c.ID, err)
+			metrics.RecordUpstreamError(c.ID, serviceName, metrics.ClassifyError(err))
 			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, path, ok := ResolveCluster(r)
+		if !ok {
+			logger.Printf("No cluster matched %s request for %s (host %s)", serviceName, r.URL.Path, r.Host)
+			http.Error(w, "Unknown cluster", http.StatusNotFound)
 			return
 		}
-		defer resp.Body.Close()
 
-		// Copy response headers
-		for name, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(name, value)
-			}
-		}
+		// Count the request, its body and the response for the cluster and service
+		tracked := metrics.StartProxyRequest(c.ID, serviceName, r.Method)
+		recorder := &responseRecorder{ResponseWriter: w}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			tracked.Done(recorder.code(r), body.n, recorder.bytes)
+		}()
+		w = recorder
 
-		// Set response status
-		w.WriteHeader(resp.StatusCode)
+		base := mountPrefix(r) + strings.TrimSuffix(r.URL.Path, path)
 
-		// Copy response body
-		_, err = io.Copy(w, resp.Body)
-		if err != nil {
-			logger.Printf("Error copying response body from %s: %v", serviceName, err)
+		// Rules are matched against the path that is forwarded, so ".." cannot escape them
+		path = cleanPath(path)
+		if !access.allowed(r.Method, path) {
+			client := r.RemoteAddr
+			if id, ok := auth.IdentityFrom(r.Context()); ok {
+				client = id.String()
+			}
+			logger.Printf("Denied %s request from %s in cluster %s: %s %s", serviceName, client, c.ID, r.Method, path)
+			metrics.RecordDeniedRequest(c.ID, serviceName, r.Method)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if opts.prepare != nil {
+			if err := opts.prepare(r, path, c); err != nil {
+				status := http.StatusBadRequest
+				var tenantErr *tenant.Error
+				if errors.As(err, &tenantErr) {
+					status = tenantErr.Status
+				}
+				if status == http.StatusForbidden {
+					metrics.RecordDeniedRequest(c.ID, serviceName, r.Method)
+				}
+				logger.Printf("Refused %s request in cluster %s for %s: %v", serviceName, c.ID, path, err)
+				http.Error(w, err.Error(), status)
+				return
+			}
 		}
-	}
-}
-
-// PrometheusHandler returns an HTTP handler for proxying requests to Prometheus
-func PrometheusHandler() http.HandlerFunc {
-	prometheusURL := BuildPrometheusURL()
-	return createProxyHandler(prometheusURL, "prometheus")
-}
 
-// LokiHandler returns an HTTP handler for proxying requests to Loki
-func LokiHandler() http.HandlerFunc {
-	lokiURL := BuildLokiURL()
-	return createProxyHandler(lokiURL, "loki")
+		ctx := context.WithValue(r.Context(), routeContextKey{}, route{cluster: c, path: path, base: base})
+		reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+	}
 }
 
-// RemoteServiceHandler returns an HTTP handler for proxying requests to a custom remote service
-func RemoteServiceHandler() http.HandlerFunc {
-	if config.CFG.RemoteNamespace == "" || config.CFG.RemoteService == "" || config.CFG.RemotePort == "" {
-		return func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "Remote service not configured", http.StatusServiceUnavailable)
+// UpstreamHandler returns an HTTP handler for proxying requests to an upstream.
+// Prometheus responses are federated with cluster labels when enabled. Prometheus
+// and Loki queries are limited to the client's tenant when tenants are configured
+// and Loki requests carry the configured X-Scope-OrgID.
+func UpstreamHandler(u config.Upstream) http.HandlerFunc {
+	var opts proxyOptions
+	cfg := config.Current()
+	switch u.Name {
+	case config.PrometheusUpstream:
+		if cfg.FederateClusterLabels {
+			opts = federationOptions()
+		}
+		if tenants := tenant.NewPrometheus(cfg.PrometheusTenants); tenants != nil {
+			opts.prepare = tenants.EnforceRequest
+		}
+	case config.LokiUpstream:
+		if tenants := tenant.NewLoki(cfg); tenants != nil {
+			opts.prepare = tenants.EnforceRequest
 		}
 	}
-
-	remoteURL := BuildServiceProxyURL(config.CFG.RemoteNamespace, config.CFG.RemoteService, config.CFG.RemotePort)
-	return createProxyHandler(remoteURL, config.CFG.RemoteService)
+	return createProxyHandler(u, opts)
 }
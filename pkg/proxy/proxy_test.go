@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestRancherCheckURL(t *testing.T) {
+	defer config.Set(config.Current())
+
+	tests := []struct {
+		name     string
+		endpoint string
+		direct   bool
+		want     string
+	}{
+		{"rancher", "https://rancher.example.com", false, "https://rancher.example.com"},
+		{"direct", "https://kubernetes.default.svc", true, "https://kubernetes.default.svc/version"},
+		{"direct with trailing slash", "https://kubernetes.default.svc/", true, "https://kubernetes.default.svc/version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Set(config.Config{RancherApiEndpoint: tt.endpoint, DirectClusterAPI: tt.direct})
+			if got := RancherCheckURL(); got != tt.want {
+				t.Errorf("RancherCheckURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// mountContextKey is the request context key holding the path prefix a handler is mounted under
+type mountContextKey struct{}
+
+// Mount serves h under prefix. The prefix is removed from the request path the
+// same way http.StripPrefix does, and remembered so that redirects returned by
+// the upstream can be mapped back under it.
+func Mount(prefix string, h http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	strip := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), mountContextKey{}, prefix)
+		strip.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// mountPrefix returns the prefix the request was mounted under, or ""
+func mountPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(mountContextKey{}).(string)
+	return prefix
+}
+
+// rewriteLocation maps a Location header returned through the service proxy
+// back to the path the client used. base is the client-facing path of the
+// upstream root, e.g. /svc/tempo/clusters/c-m-abc123. Locations under the
+// service proxy URL and host-relative paths of the upstream are rebased;
+// relative references and redirects to other hosts are left alone.
+func rewriteLocation(location string, target *url.URL, base string) string {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	servicePath := strings.TrimSuffix(target.Path, "/")
+	underService := loc.Path == servicePath || strings.HasPrefix(loc.Path, servicePath+"/")
+	switch {
+	case loc.Host != "":
+		// Absolute URLs are only rewritten when they point into the service proxy
+		if loc.Host != target.Host || !underService {
+			return location
+		}
+	case !strings.HasPrefix(loc.Path, "/"):
+		return location
+	}
+
+	path := loc.Path
+	if underService {
+		path = strings.TrimPrefix(path, servicePath)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	rewritten := url.URL{Path: base + path, RawQuery: loc.RawQuery, Fragment: loc.Fragment}
+	return rewritten.String()
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// clusterPathPrefix is the path prefix used to select a cluster, e.g. /clusters/c-m-abc123/api/v1/query
+const clusterPathPrefix = "/clusters/"
+
+// ResolveCluster determines which cluster a request targets and returns the
+// request path with any cluster routing prefix removed. Requests are matched by
+// path prefix first and then, when CLUSTER_ROUTING=host, by Host header. When a
+// single cluster is registered it is used for requests without routing info.
+func ResolveCluster(r *http.Request) (cluster.Cluster, string, bool) {
+	if strings.HasPrefix(r.URL.Path, clusterPathPrefix) {
+		rest := strings.TrimPrefix(r.URL.Path, clusterPathPrefix)
+		clusterKey, path, _ := strings.Cut(rest, "/")
+		c, ok := cluster.Default.Lookup(clusterKey)
+		return c, "/" + path, ok
+	}
+
+	if config.Current().ClusterRouting == "host" {
+		if c, ok := lookupClusterByHost(r.Host); ok {
+			return c, r.URL.Path, true
+		}
+	}
+
+	c, ok := cluster.Default.Only()
+	return c, r.URL.Path, ok
+}
+
+// lookupClusterByHost matches the first DNS label of the Host header against
+// cluster IDs and names, e.g. c-m-abc123.relay.example.com
+func lookupClusterByHost(hostHeader string) (cluster.Cluster, bool) {
+	host := hostHeader
+	if h, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = h
+	}
+	label, _, _ := strings.Cut(host, ".")
+	if label == "" {
+		return cluster.Cluster{}, false
+	}
+	return cluster.Default.Lookup(label)
+}
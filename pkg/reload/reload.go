@@ -0,0 +1,303 @@
+package reload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+)
+
+var logger = logging.SetupLogging()
+
+// Status describes the configuration in effect and the outcome of reloads
+type Status struct {
+	File            string     `json:"file,omitempty"`
+	Checksum        string     `json:"checksum,omitempty"`
+	AppliedAt       time.Time  `json:"appliedAt"`
+	LastAttempt     *time.Time `json:"lastAttempt,omitempty"`
+	LastTrigger     string     `json:"lastTrigger,omitempty"`
+	LastResult      string     `json:"lastResult,omitempty"`
+	LastErrors      []string   `json:"lastErrors,omitempty"`
+	RestartRequired []string   `json:"restartRequired,omitempty"`
+	Successes       uint64     `json:"successes"`
+	Failures        uint64     `json:"failures"`
+}
+
+// Results reported in Status.LastResult
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	statusMu sync.RWMutex
+	status   = Status{AppliedAt: time.Now()}
+)
+
+// CurrentStatus returns the reload status of this process
+func CurrentStatus() Status {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+
+	s := status
+	s.LastErrors = append([]string(nil), status.LastErrors...)
+	s.RestartRequired = append([]string(nil), status.RestartRequired...)
+	return s
+}
+
+// Reloader re-reads the config file on SIGHUP or when its contents change and
+// publishes the result through config.Current. Settings that can only take
+// effect on restart keep their running value and are reported in the status.
+type Reloader struct {
+	path string
+
+	mu       sync.Mutex
+	loaded   config.Config
+	checksum string
+	hooks    []func(config.Config) error
+}
+
+// NewReloader returns a reloader for the config file at path. loaded is the
+// configuration as read at startup, before any value derived at runtime.
+func NewReloader(path string, loaded config.Config) *Reloader {
+	r := &Reloader{path: path, loaded: loaded, checksum: checksum(path)}
+
+	statusMu.Lock()
+	status.File = path
+	status.Checksum = r.checksum
+	statusMu.Unlock()
+	return r
+}
+
+// OnReload registers fn to apply a new configuration. It runs after the
+// configuration is published; an error marks the reload as failed, and every
+// hook then runs again with the previous configuration to restore it.
+func (r *Reloader) OnReload(fn func(config.Config) error) {
+	r.mu.Lock()
+	r.hooks = append(r.hooks, fn)
+	r.mu.Unlock()
+}
+
+// Run reloads on SIGHUP, and when the file changes if interval is positive,
+// until ctx is cancelled
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && r.path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.Reload("SIGHUP")
+		case <-tick:
+			r.mu.Lock()
+			changed := checksum(r.path) != r.checksum
+			r.mu.Unlock()
+			if changed {
+				r.Reload("file change")
+			}
+		}
+	}
+}
+
+// Reload reads and validates the configuration and, if it is valid, publishes
+// it and runs the reload hooks. If a hook fails the previous configuration is
+// published and applied again. trigger is recorded in the status.
+func (r *Reloader) Reload(trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Remember the contents even if they are invalid, so a broken file is
+	// reported once and retried when it changes again
+	r.checksum = checksum(r.path)
+
+	next, err := config.Read(r.path)
+	if err != nil {
+		r.record(trigger, err, false, nil)
+		logger.Printf("Configuration reload after %s failed, keeping the running configuration: %v", trigger, err)
+		return err
+	}
+
+	loaded := next
+	previous := config.Current()
+	restart := keepRestartSettings(&next, r.loaded, previous)
+	config.Set(next)
+
+	if problems := r.apply(next); len(problems) > 0 {
+		// Restore the running configuration so that what is published is what is in effect
+		config.Set(previous)
+		if rollback := r.apply(previous); len(rollback) > 0 {
+			logger.Printf("Restoring the previous configuration reported errors: %v", &config.ValidationError{Problems: rollback})
+		}
+		err = &config.ValidationError{Problems: problems}
+		r.record(trigger, err, false, nil)
+		logger.Printf("Configuration reload after %s failed, keeping the running configuration: %v", trigger, err)
+		return err
+	}
+
+	r.loaded = loaded
+	logger.Printf("Configuration reloaded after %s", trigger)
+	for _, name := range restart {
+		logger.Printf("Warning: %s changed but only takes effect after a restart", name)
+	}
+	r.record(trigger, nil, true, restart)
+	return nil
+}
+
+// apply runs every reload hook with cfg and returns the problems they reported
+func (r *Reloader) apply(cfg config.Config) []string {
+	var problems []string
+	for _, hook := range r.hooks {
+		if err := hook(cfg); err != nil {
+			if validationErr, ok := err.(*config.ValidationError); ok {
+				problems = append(problems, validationErr.Problems...)
+			} else {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	return problems
+}
+
+// record updates the reload status after an attempt. applied is true when the
+// new configuration was put into effect.
+func (r *Reloader) record(trigger string, err error, applied bool, restart []string) {
+	now := time.Now()
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status.Checksum = r.checksum
+	status.LastAttempt = &now
+	status.LastTrigger = trigger
+	if err != nil {
+		status.LastResult = ResultFailure
+		status.Failures++
+		if validationErr, ok := err.(*config.ValidationError); ok {
+			status.LastErrors = validationErr.Problems
+		} else {
+			status.LastErrors = []string{err.Error()}
+		}
+	} else {
+		status.LastResult = ResultSuccess
+		status.Successes++
+		status.LastErrors = nil
+	}
+	if applied {
+		status.AppliedAt = now
+		status.RestartRequired = restart
+	}
+}
+
+// checksum returns the SHA-256 of the file at path, or "" if it cannot be read
+func checksum(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// keepRestartSettings copies every setting that cannot change at runtime from
+// running into next, and returns the names of those that changed in the file
+// compared to what was loaded before
+func keepRestartSettings(next *config.Config, loaded, running config.Config) []string {
+	var changed []string
+	keep := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+
+	keep("rancher.endpoint", next.RancherApiEndpoint != loaded.RancherApiEndpoint)
+	keep("rancher.insecureSkipVerify", next.RancherInsecureSkipVerify != loaded.RancherInsecureSkipVerify)
+	keep("rancher.directClusterAPI", next.DirectClusterAPI != loaded.DirectClusterAPI)
+	keep("rancher.auth", next.RancherAuthType != loaded.RancherAuthType ||
+		next.RancherApiAccessKey != loaded.RancherApiAccessKey ||
+		next.RancherApiAccessKeyFile != loaded.RancherApiAccessKeyFile ||
+		next.RancherApiSecretKey != loaded.RancherApiSecretKey ||
+		next.RancherApiSecretKeyFile != loaded.RancherApiSecretKeyFile ||
+		next.RancherApiToken != loaded.RancherApiToken ||
+		next.RancherApiTokenFile != loaded.RancherApiTokenFile ||
+		next.RancherKubeconfig != loaded.RancherKubeconfig ||
+		next.RancherKubeconfigContext != loaded.RancherKubeconfigContext ||
+		next.CredentialsReloadInterval != loaded.CredentialsReloadInterval)
+	keep("rancher.tls", next.RancherCAFile != loaded.RancherCAFile ||
+		next.RancherCAPEM != loaded.RancherCAPEM ||
+		next.RancherClientCertFile != loaded.RancherClientCertFile ||
+		next.RancherClientKeyFile != loaded.RancherClientKeyFile ||
+		next.RancherTLSMinVersion != loaded.RancherTLSMinVersion ||
+		next.RancherTLSServerName != loaded.RancherTLSServerName)
+	keep("rancher.pool", next.UpstreamMaxIdleConns != loaded.UpstreamMaxIdleConns ||
+		next.UpstreamMaxIdleConnsPerHost != loaded.UpstreamMaxIdleConnsPerHost ||
+		next.UpstreamMaxConnsPerHost != loaded.UpstreamMaxConnsPerHost ||
+		next.UpstreamIdleConnTimeout != loaded.UpstreamIdleConnTimeout ||
+		next.UpstreamHTTP2 != loaded.UpstreamHTTP2 ||
+		next.UpstreamDialTimeout != loaded.UpstreamDialTimeout ||
+		next.UpstreamTLSHandshakeTimeout != loaded.UpstreamTLSHandshakeTimeout)
+	keep("discovery", next.DiscoveryEnabled != loaded.DiscoveryEnabled ||
+		next.DiscoveryInterval != loaded.DiscoveryInterval ||
+		next.DiscoveryLabelSelector != loaded.DiscoveryLabelSelector ||
+		next.DiscoveryNameRegex != loaded.DiscoveryNameRegex ||
+		fmt.Sprint(next.DiscoveryStates) != fmt.Sprint(loaded.DiscoveryStates) ||
+		next.DiscoveryIncludeLocal != loaded.DiscoveryIncludeLocal)
+	keep("reloadInterval", next.ConfigReloadInterval != loaded.ConfigReloadInterval)
+
+	// Rancher connection, credentials, pools and discovery are set up once at startup
+	next.RancherApiEndpoint = running.RancherApiEndpoint
+	next.RancherInsecureSkipVerify = running.RancherInsecureSkipVerify
+	next.DirectClusterAPI = running.DirectClusterAPI
+	next.RancherAuthType = running.RancherAuthType
+	next.RancherApiAccessKey = running.RancherApiAccessKey
+	next.RancherApiAccessKeyFile = running.RancherApiAccessKeyFile
+	next.RancherApiSecretKey = running.RancherApiSecretKey
+	next.RancherApiSecretKeyFile = running.RancherApiSecretKeyFile
+	next.RancherApiToken = running.RancherApiToken
+	next.RancherApiTokenFile = running.RancherApiTokenFile
+	next.RancherKubeconfig = running.RancherKubeconfig
+	next.RancherKubeconfigContext = running.RancherKubeconfigContext
+	next.CredentialsReloadInterval = running.CredentialsReloadInterval
+	next.RancherCAFile = running.RancherCAFile
+	next.RancherCAPEM = running.RancherCAPEM
+	next.RancherClientCertFile = running.RancherClientCertFile
+	next.RancherClientKeyFile = running.RancherClientKeyFile
+	next.RancherTLSMinVersion = running.RancherTLSMinVersion
+	next.RancherTLSServerName = running.RancherTLSServerName
+	next.UpstreamMaxIdleConns = running.UpstreamMaxIdleConns
+	next.UpstreamMaxIdleConnsPerHost = running.UpstreamMaxIdleConnsPerHost
+	next.UpstreamMaxConnsPerHost = running.UpstreamMaxConnsPerHost
+	next.UpstreamIdleConnTimeout = running.UpstreamIdleConnTimeout
+	next.UpstreamHTTP2 = running.UpstreamHTTP2
+	next.UpstreamDialTimeout = running.UpstreamDialTimeout
+	next.UpstreamTLSHandshakeTimeout = running.UpstreamTLSHandshakeTimeout
+	next.DiscoveryEnabled = running.DiscoveryEnabled
+	next.DiscoveryInterval = running.DiscoveryInterval
+	next.DiscoveryLabelSelector = running.DiscoveryLabelSelector
+	next.DiscoveryNameRegex = running.DiscoveryNameRegex
+	next.DiscoveryStates = running.DiscoveryStates
+	next.DiscoveryIncludeLocal = running.DiscoveryIncludeLocal
+	next.ConfigReloadInterval = running.ConfigReloadInterval
+
+	return changed
+}
@@ -0,0 +1,73 @@
+package reload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// writeConfig writes a minimal config file serving metrics on metricsPort
+func writeConfig(t *testing.T, path, metricsPort string) {
+	t.Helper()
+	data := fmt.Sprintf(`version: 1
+rancher:
+  endpoint: https://rancher.example.com
+  auth:
+    token: token
+clusters:
+  - id: c-1
+listeners:
+  metricsPort: "%s"
+`, metricsPort)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadRestoresConfigWhenHookFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "9000")
+	loaded, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReloader(path, loaded)
+	var applied []string
+	r.OnReload(func(cfg config.Config) error {
+		applied = append(applied, cfg.MetricsPort)
+		if cfg.MetricsPort == "9100" {
+			return fmt.Errorf("metrics listener on :9100: address already in use")
+		}
+		return nil
+	})
+
+	writeConfig(t, path, "9100")
+	if err := r.Reload("test"); err == nil {
+		t.Fatal("Reload succeeded, want the hook error")
+	}
+	if got := config.Current().MetricsPort; got != "9000" {
+		t.Errorf("published metrics port %s after a failed reload, want 9000", got)
+	}
+	if fmt.Sprint(applied) != "[9100 9000]" {
+		t.Errorf("hooks applied %v, want the new then the previous configuration", applied)
+	}
+	if status := CurrentStatus(); status.LastResult != ResultFailure {
+		t.Errorf("last result %q, want %q", status.LastResult, ResultFailure)
+	}
+
+	applied = nil
+	writeConfig(t, path, "9200")
+	if err := r.Reload("test"); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := config.Current().MetricsPort; got != "9200" {
+		t.Errorf("published metrics port %s, want 9200", got)
+	}
+	if fmt.Sprint(applied) != "[9200]" {
+		t.Errorf("hooks applied %v, want only the new configuration", applied)
+	}
+}
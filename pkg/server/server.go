@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+)
+
+var logger = logging.SetupLogging()
+
+// drainTimeout bounds how long a removed listener waits for in-flight requests
+const drainTimeout = 2 * time.Minute
+
+// Timeouts of listeners that are not streaming
+var (
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 2 * time.Minute // fan-out queries wait on every cluster
+	readHeaderTimeout = 5 * time.Second
+)
+
+// ErrShutdown is returned by Apply once the manager has been shut down
+var ErrShutdown = errors.New("server manager is shut down")
+
+// Listener is an HTTP server the relay should be running
+type Listener struct {
+	Name string
+	// Network is "tcp" or "unix"; Addr is a host:port pair or a socket path
+	Network string
+	Addr    string
+	TLS     TLS
+	Handler http.Handler
+
+	// Streaming listeners have no read/write timeouts: streamed responses and
+	// WebSocket tails can run indefinitely
+	Streaming bool
+}
+
+// Manager runs the relay's listeners and reconciles them with a new set on
+// reload. Listeners whose address is unchanged keep their socket and open
+// connections and only switch to the new handler; removed or moved listeners
+// stop accepting and drain in-flight requests in the background.
+type Manager struct {
+	mu       sync.Mutex
+	running  map[string]*runningServer
+	shutdown bool
+
+	// inFlight counts requests being served by any listener, including
+	// upgraded connections that http.Server no longer tracks
+	inFlight atomic.Int64
+
+	errs chan error
+}
+
+// runningServer is a started listener
+type runningServer struct {
+	listener Listener
+	server   *http.Server
+	handler  *handlerSwitch
+	tls      *tlsListener
+}
+
+// sameSocket reports whether l can keep serving on the running socket
+func (rs *runningServer) sameSocket(l Listener) bool {
+	return rs.listener.Network == l.Network && rs.listener.Addr == l.Addr
+}
+
+// update switches a running listener to the handler and TLS settings of l
+func (rs *runningServer) update(l Listener) error {
+	if rs.listener.TLS != l.TLS {
+		tlsConfig, err := l.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+		rs.tls.config.Store(tlsConfig)
+		logger.Printf("Serving %s listener on %s over %s", l.Name, l.Addr, l.TLS.scheme())
+	}
+	rs.handler.set(l.Handler)
+	rs.listener = l
+	return nil
+}
+
+// NewManager returns a manager with no listeners
+func NewManager() *Manager {
+	return &Manager{running: make(map[string]*runningServer), errs: make(chan error, 1)}
+}
+
+// Errors returns a channel receiving the first error of a listener that stopped
+// serving unexpectedly
+func (m *Manager) Errors() <-chan error {
+	return m.errs
+}
+
+// InFlight returns the number of requests currently being served
+func (m *Manager) InFlight() int64 {
+	return m.inFlight.Load()
+}
+
+// Apply starts, updates and stops listeners so that exactly the given set is
+// running. Listeners that fail to start are reported together; the others are
+// still applied.
+func (m *Manager) Apply(listeners []Listener) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shutdown {
+		return ErrShutdown
+	}
+
+	wanted := make(map[string]bool, len(listeners))
+	for _, l := range listeners {
+		wanted[l.Name] = true
+	}
+
+	// Listeners that are removed or moved normally keep serving until their
+	// replacement is up. One whose address is taken over by another listener,
+	// e.g. when two listeners swap ports or one is renamed, must release its
+	// socket first or the new listener could not bind it.
+	for name, rs := range m.running {
+		for _, l := range listeners {
+			if l.Name == name || !rs.sameSocket(l) {
+				continue
+			}
+			logger.Printf("Stopping %s listener on %s so that %s can take it over", name, rs.listener.Addr, l.Name)
+			release(name, rs)
+			delete(m.running, name)
+			break
+		}
+	}
+
+	var problems []string
+	for _, l := range listeners {
+		previous, ok := m.running[l.Name]
+		if ok && previous.sameSocket(l) {
+			if err := previous.update(l); err != nil {
+				problems = append(problems, fmt.Sprintf("%s listener on %s: %v", l.Name, l.Addr, err))
+			}
+			continue
+		}
+
+		rs, err := m.start(l)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s listener on %s: %v", l.Name, l.Addr, err))
+			continue
+		}
+		if ok {
+			logger.Printf("Moving %s listener from %s to %s", l.Name, previous.listener.Addr, l.Addr)
+			drain(l.Name, previous)
+		}
+		m.running[l.Name] = rs
+	}
+
+	for name, rs := range m.running {
+		if !wanted[name] {
+			logger.Printf("Stopping %s listener on %s", name, rs.listener.Addr)
+			drain(name, rs)
+			delete(m.running, name)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &config.ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Shutdown stops every listener from accepting and waits until in-flight
+// requests have finished or ctx expires. Listeners are closed and an error
+// is returned if requests were still in flight. Apply fails afterwards.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shutdown = true
+	running := make([]*runningServer, 0, len(m.running))
+	for _, rs := range m.running {
+		running = append(running, rs)
+	}
+	m.mu.Unlock()
+
+	var (
+		wg     sync.WaitGroup
+		closed atomic.Int64
+	)
+	for _, rs := range running {
+		wg.Add(1)
+		go func(rs *runningServer) {
+			defer wg.Done()
+			logger.Printf("Stopping %s listener on %s", rs.listener.Name, rs.listener.Addr)
+			if err := rs.server.Shutdown(ctx); err != nil {
+				closed.Add(1)
+				rs.server.Close()
+			}
+		}(rs)
+	}
+	wg.Wait()
+	if closed.Load() > 0 {
+		return fmt.Errorf("closed %d listener(s) with requests still in flight: %v", closed.Load(), ctx.Err())
+	}
+
+	// Listeners stopped by an earlier Apply and upgraded connections such as
+	// WebSocket tails are only covered by the in-flight count
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for m.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d request(s) still in flight: %v", m.inFlight.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// start binds the listener's address and serves it in the background
+func (m *Manager) start(l Listener) (*runningServer, error) {
+	tlsConfig, err := l.TLS.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Network == "unix" {
+		removeStaleSocket(l.Addr)
+	}
+	ln, err := net.Listen(l.Network, l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsLn := &tlsListener{Listener: ln, closed: make(chan struct{})}
+	tlsLn.config.Store(tlsConfig)
+
+	handler := &handlerSwitch{inFlight: &m.inFlight}
+	handler.set(l.Handler)
+
+	srv := &http.Server{
+		Handler:           handler,
+		IdleTimeout:       120 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if !l.Streaming {
+		srv.ReadTimeout = readTimeout
+		srv.WriteTimeout = writeTimeout
+		srv.ReadHeaderTimeout = readHeaderTimeout
+	}
+
+	logger.Printf("Starting %s listener on %s (%s)", l.Name, l.Addr, l.TLS.scheme())
+	go func() {
+		if err := srv.Serve(tlsLn); err != nil && err != http.ErrServerClosed {
+			logger.Printf("%s listener on %s failed: %v", l.Name, l.Addr, err)
+			select {
+			case m.errs <- fmt.Errorf("%s listener on %s: %v", l.Name, l.Addr, err):
+			default:
+			}
+		}
+	}()
+	return &runningServer{listener: l, server: srv, handler: handler, tls: tlsLn}, nil
+}
+
+// drain stops a listener from accepting and lets in-flight requests finish
+func drain(name string, rs *runningServer) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := rs.server.Shutdown(ctx); err != nil {
+			logger.Printf("Closing %s listener on %s with requests still in flight: %v", name, rs.listener.Addr, err)
+			rs.server.Close()
+		}
+	}()
+}
+
+// release stops a listener like drain but only returns once its socket is closed
+func release(name string, rs *runningServer) {
+	drain(name, rs)
+	<-rs.tls.closed
+}
+
+// removeStaleSocket removes a socket file left behind at path by a previous
+// process that was killed
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// handlerSwitch is an http.Handler that can be replaced while serving
+type handlerSwitch struct {
+	handler  atomic.Pointer[http.Handler]
+	inFlight *atomic.Int64
+}
+
+// set replaces the handler used for new requests
+func (h *handlerSwitch) set(handler http.Handler) {
+	h.handler.Store(&handler)
+}
+
+// ServeHTTP serves the request with the current handler
+func (h *handlerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.inFlight.Add(1)
+	defer h.inFlight.Add(-1)
+	(*h.handler.Load()).ServeHTTP(w, r)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// newManager returns a manager that is shut down at the end of the test
+func newManager(t *testing.T) *Manager {
+	m := NewManager()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m.Shutdown(ctx)
+	})
+	return m
+}
+
+// named returns a handler answering with name
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	})
+}
+
+// get returns the body served at addr, failing the test on error
+func get(t *testing.T, addr string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", addr, err)
+	}
+	return string(body)
+}
+
+func TestApplyReusesAddresses(t *testing.T) {
+	first, second := freeAddr(t), freeAddr(t)
+
+	tests := []struct {
+		name   string
+		before []Listener
+		after  []Listener
+		want   map[string]string
+	}{
+		{
+			name:   "swap ports",
+			before: []Listener{{Name: "a", Network: "tcp", Addr: first, Handler: named("a")}, {Name: "b", Network: "tcp", Addr: second, Handler: named("b")}},
+			after:  []Listener{{Name: "a", Network: "tcp", Addr: second, Handler: named("a")}, {Name: "b", Network: "tcp", Addr: first, Handler: named("b")}},
+			want:   map[string]string{first: "b", second: "a"},
+		},
+		{
+			name:   "rename on the same address",
+			before: []Listener{{Name: "old", Network: "tcp", Addr: first, Handler: named("old")}},
+			after:  []Listener{{Name: "new", Network: "tcp", Addr: first, Handler: named("new")}},
+			want:   map[string]string{first: "new"},
+		},
+		{
+			name:   "move to a new address",
+			before: []Listener{{Name: "a", Network: "tcp", Addr: first, Handler: named("a")}},
+			after:  []Listener{{Name: "a", Network: "tcp", Addr: second, Handler: named("a")}},
+			want:   map[string]string{second: "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newManager(t)
+
+			if err := m.Apply(tt.before); err != nil {
+				t.Fatalf("first Apply: %v", err)
+			}
+			if err := m.Apply(tt.after); err != nil {
+				t.Fatalf("second Apply: %v", err)
+			}
+			for addr, want := range tt.want {
+				if got := get(t, addr); got != want {
+					t.Errorf("%s served %q, want %q", addr, got, want)
+				}
+			}
+			select {
+			case err := <-m.Errors():
+				t.Errorf("listener failed: %v", err)
+			default:
+			}
+		})
+	}
+}
+
+func TestStreamingListenerOutlivesReadTimeout(t *testing.T) {
+	defer func(read, write time.Duration) { readTimeout, writeTimeout = read, write }(readTimeout, writeTimeout)
+	readTimeout, writeTimeout = 200*time.Millisecond, 200*time.Millisecond
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	})
+
+	for _, streaming := range []bool{true, false} {
+		t.Run(fmt.Sprintf("streaming=%v", streaming), func(t *testing.T) {
+			addr := freeAddr(t)
+			m := newManager(t)
+			if err := m.Apply([]Listener{{Name: "proxy", Network: "tcp", Addr: addr, Handler: echo, Streaming: streaming}}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Upload the body slowly, well past the read timeout
+			body, writer := io.Pipe()
+			go func() {
+				for i := 0; i < 6; i++ {
+					time.Sleep(100 * time.Millisecond)
+					fmt.Fprintf(writer, "chunk%d\n", i)
+				}
+				writer.Close()
+			}()
+
+			resp, err := http.Post("http://"+addr+"/", "text/plain", body)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			complete := err == nil && resp.StatusCode == http.StatusOK && strings.Count(string(got), "chunk") == 6
+
+			if complete != streaming {
+				t.Errorf("request completed = %v, want %v (err %v)", complete, streaming, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certCheckInterval is how often the files of a serving certificate are checked for changes
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS configures HTTPS on a listener. The zero value serves plain HTTP.
+type TLS struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion string
+
+	// ClientCAFile, if set, verifies client certificates that are presented.
+	// Whether a certificate is required is left to the handler.
+	ClientCAFile string
+}
+
+// scheme returns the URL scheme the listener serves
+func (t TLS) scheme() string {
+	if t.CertFile == "" {
+		return "http"
+	}
+	return "https"
+}
+
+// serverConfig returns the TLS configuration of a listener, or nil for plain
+// HTTP. The key pair is read now, so a missing or invalid certificate fails
+// the listener, and again whenever its files change.
+func (t TLS) serverConfig() (*tls.Config, error) {
+	if t.CertFile == "" {
+		return nil, nil
+	}
+	cert := &certificate{certFile: t.CertFile, keyFile: t.KeyFile, clientCAFile: t.ClientCAFile}
+	if err := cert.reload(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tlsVersions[t.MinVersion],
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if t.ClientCAFile == "" {
+		config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			keyPair, _ := cert.current()
+			return keyPair, nil
+		}
+		return config, nil
+	}
+
+	// The client CA pool is part of the per-connection configuration so that
+	// it follows changes to its file like the key pair does
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		keyPair, clientCAs := cert.current()
+		return &tls.Config{
+			MinVersion:   config.MinVersion,
+			NextProtos:   config.NextProtos,
+			Certificates: []tls.Certificate{*keyPair},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}, nil
+	}
+	return config, nil
+}
+
+// tlsListener serves TLS on accepted connections while a configuration is
+// set, so HTTPS can be switched on or off without closing the socket
+type tlsListener struct {
+	net.Listener
+	config atomic.Pointer[tls.Config]
+
+	// closed is closed once the socket has been released
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Close releases the socket
+func (l *tlsListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.closed) })
+	return err
+}
+
+// Accept waits for the next connection and wraps it in TLS if enabled
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if config := l.config.Load(); config != nil {
+		return tls.Server(conn, config), nil
+	}
+	return conn, nil
+}
+
+// certificate is a key pair and optional client CA bundle read from disk that
+// follow changes to their files, e.g. when cert-manager renews a mounted Secret
+type certificate struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checked   time.Time
+}
+
+// current returns the key pair and client CAs, reloading them first if their files changed
+func (c *certificate) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if c.latestModTime() != c.modTime {
+			if err := c.reload(); err != nil {
+				logger.Printf("Error reloading TLS certificate %s, keeping the previous one: %v", c.certFile, err)
+			} else {
+				logger.Printf("Reloaded TLS certificate %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, c.clientCAs
+}
+
+// reload reads the key pair and client CAs from disk
+func (c *certificate) reload() error {
+	changed := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", c.clientCAFile)
+		}
+	}
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.modTime = changed
+	c.checked = time.Now()
+	return nil
+}
+
+// latestModTime returns the latest modification time of the certificate files
+func (c *certificate) latestModTime() time.Time {
+	return modTime(c.certFile, c.keyFile, c.clientCAFile)
+}
+
+// modTime returns the latest modification time of the given files
+func modTime(paths ...string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,242 @@
+package tenant
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// OrgIDHeader selects the tenant of a multi-tenant Loki
+const OrgIDHeader = "X-Scope-OrgID"
+
+// lokiEndpoint is a Loki API path a restricted tenant may use and the
+// parameter holding its LogQL query or stream selectors
+type lokiEndpoint struct {
+	param string
+	// optional parameters are set to the tenant's selector when missing
+	optional bool
+}
+
+// Loki API paths a restricted tenant may use
+var lokiEndpoints = map[string]lokiEndpoint{
+	"/loki/api/v1/query":              {param: "query"},
+	"/loki/api/v1/query_range":        {param: "query"},
+	"/loki/api/v1/tail":               {param: "query"},
+	"/loki/api/v1/index/stats":        {param: "query"},
+	"/loki/api/v1/index/volume":       {param: "query"},
+	"/loki/api/v1/index/volume_range": {param: "query"},
+	"/api/prom/query":                 {param: "query"},
+	"/api/prom/tail":                  {param: "query"},
+	"/loki/api/v1/series":             {param: "match[]", optional: true},
+	"/loki/api/v1/labels":             {param: "query", optional: true},
+	"/loki/api/v1/label/*/values":     {param: "query", optional: true},
+	// Version detection of Grafana and readiness checks carry no log data
+	"/loki/api/v1/status/buildinfo": {},
+	"/ready":                        {},
+}
+
+// Loki limits the LogQL of each client to the streams of its tenant and
+// decides the X-Scope-OrgID sent to Loki
+type Loki struct {
+	tenants []tenant
+	orgIDs  map[string]string
+	orgID   string
+}
+
+// NewLoki returns the restrictions configured for Loki, or nil when neither
+// tenants nor an org ID are set and client requests are passed through as is
+func NewLoki(cfg config.Config) *Loki {
+	if len(cfg.LokiTenants) == 0 && cfg.LokiOrgID == "" {
+		return nil
+	}
+	l := &Loki{tenants: compile(cfg.LokiTenants), orgIDs: make(map[string]string), orgID: cfg.LokiOrgID}
+	for _, t := range cfg.LokiTenants {
+		l.orgIDs[t.Name] = t.OrgID
+	}
+	return l
+}
+
+// OrgID is an X-Scope-OrgID template
+type OrgID string
+
+// For returns the org ID to send to Loki in cluster c, or "" for none
+func (o OrgID) For(c cluster.Cluster) string {
+	return strings.NewReplacer("{cluster_id}", c.ID, "{cluster_name}", c.DisplayName()).Replace(string(o))
+}
+
+// Enforce checks a request for the Loki API path apiPath and returns its
+// parameters with the tenant's matchers added to every stream selector, and the
+// org ID to send. An *Error is returned when the request is refused.
+func (l *Loki) Enforce(r *http.Request, apiPath string, params url.Values) (url.Values, OrgID, error) {
+	orgID := OrgID(l.orgID)
+	if len(l.tenants) == 0 {
+		return params, orgID, nil
+	}
+	t, err := lookup(l.tenants, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if l.orgIDs[t.name] != "" {
+		orgID = OrgID(l.orgIDs[t.name])
+	}
+	if len(t.matchers) == 0 {
+		return params, orgID, nil
+	}
+
+	endpoint, ok := findLokiEndpoint(apiPath)
+	if !ok {
+		return nil, "", forbidden("%s is not available to tenant %s", apiPath, t.name)
+	}
+	if endpoint.param == "" {
+		return params, orgID, nil
+	}
+
+	enforced := make(url.Values, len(params))
+	for key, values := range params {
+		enforced[key] = values
+	}
+	values := params[endpoint.param]
+	if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+		if !endpoint.optional {
+			return nil, "", badRequest("%s requires a %s parameter", apiPath, endpoint.param)
+		}
+		enforced[endpoint.param] = []string{selectorString(t.matchers)}
+		return enforced, orgID, nil
+	}
+	queries := make([]string, 0, len(values))
+	for _, value := range values {
+		query, err := enforceLogQL(value, t.matchers)
+		if err != nil {
+			return nil, "", err
+		}
+		queries = append(queries, query)
+	}
+	enforced[endpoint.param] = queries
+	return enforced, orgID, nil
+}
+
+// EnforceRequest applies Enforce to the parameters of r in place and replaces
+// any X-Scope-OrgID the client sent
+func (l *Loki) EnforceRequest(r *http.Request, apiPath string, c cluster.Cluster) error {
+	params, err := requestParams(r)
+	if err != nil {
+		return err
+	}
+	enforced, orgID, err := l.Enforce(r, apiPath, params)
+	if err != nil {
+		return err
+	}
+	setRequestParams(r, enforced)
+	r.Header.Del(OrgIDHeader)
+	if value := orgID.For(c); value != "" {
+		r.Header.Set(OrgIDHeader, value)
+	}
+	return nil
+}
+
+// findLokiEndpoint returns the restrictions of an API path
+func findLokiEndpoint(apiPath string) (lokiEndpoint, bool) {
+	for pattern, endpoint := range lokiEndpoints {
+		if ok, _ := path.Match(pattern, apiPath); ok {
+			return endpoint, true
+		}
+	}
+	return lokiEndpoint{}, false
+}
+
+// enforceLogQL adds the matchers to every stream selector of a LogQL query.
+// Selectors are the brace blocks outside string literals; comments are
+// dropped so that nothing hidden in them can be read as a selector by Loki.
+func enforceLogQL(query string, matchers []*labels.Matcher) (string, error) {
+	var b strings.Builder
+	selectors := 0
+	for i := 0; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			end := stringEnd(query, i)
+			if end < 0 {
+				return "", badRequest("invalid query: unterminated string")
+			}
+			b.WriteString(query[i:end])
+			i = end
+		case '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case '{':
+			end, err := selectorEnd(query, i)
+			if err != nil {
+				return "", err
+			}
+			parsed, err := parser.ParseMetricSelector(query[i:end])
+			if err != nil {
+				return "", badRequest("invalid stream selector %s: %v", query[i:end], err)
+			}
+			parsed, err = enforceMatchers(parsed, matchers)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(selectorString(parsed))
+			selectors++
+			i = end
+		default:
+			b.WriteByte(query[i])
+			i++
+		}
+	}
+	if selectors == 0 {
+		return "", badRequest("invalid query: no stream selector")
+	}
+	return b.String(), nil
+}
+
+// stringEnd returns the index after the string literal starting at start, or
+// -1 if it is not terminated
+func stringEnd(query string, start int) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '\\' && quote == '"':
+			i++
+		case query[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// selectorEnd returns the index after the stream selector starting at start
+func selectorEnd(query string, start int) (int, error) {
+	for i := start + 1; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			end := stringEnd(query, i)
+			if end < 0 {
+				return 0, badRequest("invalid query: unterminated string")
+			}
+			i = end
+		case '}':
+			return i + 1, nil
+		case '{', '#':
+			return 0, badRequest("invalid stream selector in query")
+		default:
+			i++
+		}
+	}
+	return 0, badRequest("invalid query: unterminated stream selector")
+}
+
+// selectorString renders matchers as a LogQL stream selector
+func selectorString(matchers []*labels.Matcher) string {
+	rendered := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		rendered = append(rendered, m.String())
+	}
+	return "{" + strings.Join(rendered, ", ") + "}"
+}
@@ -0,0 +1,118 @@
+package tenant
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestLokiEnforceLogQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   string
+		status int
+	}{
+		{name: "selector", query: `{app="a"}`, want: `{app="a", namespace="team-a"}`},
+		{name: "selector in a double-quoted filter", query: `{app="a"} |= "{namespace=\"kube-system\"}"`, want: `{app="a", namespace="team-a"} |= "{namespace=\"kube-system\"}"`},
+		{name: "escaped quotes", query: `{app="a"} |= "say \"hi\" {x}" != "\\"`, want: `{app="a", namespace="team-a"} |= "say \"hi\" {x}" != "\\"`},
+		{name: "selector in a backtick filter", query: "{app=\"a\"} |~ `{namespace=\"kube-system\"}`", want: "{app=\"a\", namespace=\"team-a\"} |~ `{namespace=\"kube-system\"}`"},
+		{name: "braces in a selector value", query: `{app=~"a{2}"}`, want: `{app=~"a{2}", namespace="team-a"}`},
+		{name: "comment dropped", query: `{app="a"} # {namespace="kube-system"}`, want: `{app="a", namespace="team-a"} `},
+		{name: "comment ends at the line", query: "{app=\"a\"} # note\n|= \"x\"", want: "{app=\"a\", namespace=\"team-a\"} \n|= \"x\""},
+		{name: "quote in a comment", query: "{app=\"a\"} # it's \"\n|= \"x\"", want: "{app=\"a\", namespace=\"team-a\"} \n|= \"x\""},
+		{
+			name:  "several selectors",
+			query: `sum(count_over_time({app="a"}[5m])) / sum(count_over_time({app="b"} |= "x" [5m]))`,
+			want:  `sum(count_over_time({app="a", namespace="team-a"}[5m])) / sum(count_over_time({app="b", namespace="team-a"} |= "x" [5m]))`,
+		},
+		{name: "label_format template", query: `{app="a"} | logfmt | label_format dst="{{.src}}"`, want: `{app="a", namespace="team-a"} | logfmt | label_format dst="{{.src}}"`},
+		{name: "line_format template", query: "{app=\"a\"} | line_format `{{.app}} {{ if .x }}{{.x}}{{ end }}`", want: "{app=\"a\", namespace=\"team-a\"} | line_format `{{.app}} {{ if .x }}{{.x}}{{ end }}`"},
+		{name: "tenant matcher repeated", query: `{namespace="team-a"}`, want: `{namespace="team-a"}`},
+		{name: "other namespace", query: `{namespace="kube-system"}`, status: http.StatusForbidden},
+		{name: "other namespace in a later selector", query: `{app="a"} or {namespace="kube-system"}`, status: http.StatusForbidden},
+		{name: "regular expression override", query: `{namespace=~".+"}`, status: http.StatusForbidden},
+		{name: "negative override", query: `{namespace!="team-a"}`, status: http.StatusForbidden},
+		{name: "nested selector", query: `{app="a", x={b="c"}}`, status: http.StatusBadRequest},
+		{name: "comment in a selector", query: "{app=\"a\" # }\n}", status: http.StatusBadRequest},
+		{name: "unterminated selector", query: `{app="a"`, status: http.StatusBadRequest},
+		{name: "unterminated string", query: `{app="a"} |= "x`, status: http.StatusBadRequest},
+		{name: "unterminated string in a selector", query: `{app="a}`, status: http.StatusBadRequest},
+		{name: "escaped closing quote", query: `{app="a"} |= "x\"`, status: http.StatusBadRequest},
+		{name: "invalid matcher", query: `{app}`, status: http.StatusBadRequest},
+		{name: "no selector", query: `vector(1)`, status: http.StatusBadRequest},
+		{name: "selector only in a comment", query: `# {app="a"}`, status: http.StatusBadRequest},
+	}
+
+	l := NewLoki(config.Config{LokiTenants: []config.Tenant{teamA}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := authenticated(t, "/loki/api/v1/query_range")
+			params, _, err := l.Enforce(r, "/loki/api/v1/query_range", url.Values{"query": {tt.query}, "limit": {"10"}})
+			checkRefusal(t, err, tt.status)
+			if tt.status != 0 {
+				return
+			}
+			if params.Get("query") != tt.want {
+				t.Errorf("query %s, want %s", params.Get("query"), tt.want)
+			}
+			if params.Get("limit") != "10" {
+				t.Errorf("limit %q, want the other parameters kept", params.Get("limit"))
+			}
+		})
+	}
+}
+
+func TestLokiEnforceEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		params url.Values
+		want   url.Values
+		status int
+	}{
+		{name: "labels without query", path: "/loki/api/v1/labels", params: url.Values{}, want: url.Values{"query": {`{namespace="team-a"}`}}},
+		{name: "label values", path: "/loki/api/v1/label/app/values", params: url.Values{"query": {`{app="a"}`}}, want: url.Values{"query": {`{app="a", namespace="team-a"}`}}},
+		{name: "series", path: "/loki/api/v1/series", params: url.Values{"match[]": {`{app="a"}`, `{app="b"}`}}, want: url.Values{"match[]": {`{app="a", namespace="team-a"}`, `{app="b", namespace="team-a"}`}}},
+		{name: "query required", path: "/loki/api/v1/query", params: url.Values{}, status: http.StatusBadRequest},
+		{name: "readiness", path: "/ready", params: url.Values{}, want: url.Values{}},
+		{name: "push", path: "/loki/api/v1/push", params: url.Values{}, status: http.StatusForbidden},
+	}
+
+	l := NewLoki(config.Config{LokiTenants: []config.Tenant{teamA}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _, err := l.Enforce(authenticated(t, tt.path), tt.path, tt.params)
+			checkRefusal(t, err, tt.status)
+			if tt.status == 0 && !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("parameters %v, want %v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestLokiOrgID(t *testing.T) {
+	c := cluster.Cluster{ID: "c-1", Name: "prod"}
+	r := authenticated(t, "/loki/api/v1/query")
+	params := url.Values{"query": {`{app="a"}`}}
+
+	shared := NewLoki(config.Config{LokiOrgID: "{cluster_id}-{cluster_name}"})
+	_, orgID, err := shared.Enforce(r, "/loki/api/v1/query", params)
+	checkRefusal(t, err, 0)
+	if got := orgID.For(c); got != "c-1-prod" {
+		t.Errorf("org ID %q, want c-1-prod", got)
+	}
+
+	withTenant := teamA
+	withTenant.OrgID = "team-a"
+	tenants := NewLoki(config.Config{LokiOrgID: "{cluster_id}", LokiTenants: []config.Tenant{withTenant}})
+	_, orgID, err = tenants.Enforce(r, "/loki/api/v1/query", params)
+	checkRefusal(t, err, 0)
+	if got := orgID.For(c); got != "team-a" {
+		t.Errorf("org ID %q, want the tenant's team-a", got)
+	}
+}
@@ -0,0 +1,192 @@
+package tenant
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/cluster"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// Prometheus API paths a restricted tenant may use, with the parameter holding
+// the PromQL expression or series selectors of each
+var prometheusEndpoints = map[string]string{
+	"/api/v1/query":           "query",
+	"/api/v1/query_range":     "query",
+	"/api/v1/query_exemplars": "query",
+	"/api/v1/series":          "match[]",
+	"/api/v1/labels":          "match[]",
+	"/api/v1/label/*/values":  "match[]",
+	"/federate":               "match[]",
+	// Version detection of Grafana and readiness checks carry no series data
+	"/api/v1/status/buildinfo": "",
+	"/-/ready":                 "",
+	"/-/healthy":               "",
+}
+
+// Prometheus limits the PromQL of each client to the series of its tenant
+type Prometheus struct {
+	tenants []tenant
+}
+
+// NewPrometheus returns the restrictions for the given tenants, or nil when
+// there are none
+func NewPrometheus(tenants []config.Tenant) *Prometheus {
+	if len(tenants) == 0 {
+		return nil
+	}
+	return &Prometheus{tenants: compile(tenants)}
+}
+
+// Enforce checks a request for the Prometheus API path apiPath and returns its
+// parameters with the tenant's matchers added to every selector. Requests of
+// unrestricted tenants are returned unchanged. An *Error is returned when the
+// request is refused.
+func (p *Prometheus) Enforce(r *http.Request, apiPath string, params url.Values) (url.Values, error) {
+	t, err := lookup(p.tenants, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.matchers) == 0 {
+		return params, nil
+	}
+
+	param, ok := prometheusEndpoint(apiPath)
+	if !ok {
+		return nil, forbidden("%s is not available to tenant %s", apiPath, t.name)
+	}
+	if param == "" {
+		return params, nil
+	}
+
+	enforced := make(url.Values, len(params))
+	for key, values := range params {
+		enforced[key] = values
+	}
+	if param == "query" {
+		query, err := enforceQuery(params.Get("query"), t.matchers)
+		if err != nil {
+			return nil, err
+		}
+		enforced.Set("query", query)
+		return enforced, nil
+	}
+
+	selectors, err := enforceSelectors(params["match[]"], t.matchers)
+	if err != nil {
+		return nil, err
+	}
+	enforced["match[]"] = selectors
+	return enforced, nil
+}
+
+// EnforceRequest applies Enforce to the parameters of r in place. Prometheus
+// restrictions are the same in every cluster.
+func (p *Prometheus) EnforceRequest(r *http.Request, apiPath string, _ cluster.Cluster) error {
+	params, err := requestParams(r)
+	if err != nil {
+		return err
+	}
+	enforced, err := p.Enforce(r, apiPath, params)
+	if err != nil {
+		return err
+	}
+	setRequestParams(r, enforced)
+	return nil
+}
+
+// prometheusEndpoint returns the parameter to enforce for an API path
+func prometheusEndpoint(apiPath string) (string, bool) {
+	for pattern, param := range prometheusEndpoints {
+		if ok, _ := path.Match(pattern, apiPath); ok {
+			return param, true
+		}
+	}
+	return "", false
+}
+
+// enforceQuery adds the matchers to every selector of a PromQL expression
+func enforceQuery(query string, matchers []*labels.Matcher) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", badRequest("invalid query: %v", err)
+	}
+	var refused error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if selector, ok := node.(*parser.VectorSelector); ok {
+			selector.LabelMatchers, err = enforceMatchers(selector.LabelMatchers, matchers)
+			if err != nil {
+				refused = err
+				return err
+			}
+		}
+		return nil
+	})
+	if refused != nil {
+		return "", refused
+	}
+	return expr.String(), nil
+}
+
+// enforceSelectors adds the matchers to every series selector. Without any
+// selector the matchers alone select the tenant's series.
+func enforceSelectors(selectors []string, matchers []*labels.Matcher) ([]string, error) {
+	if len(selectors) == 0 {
+		return []string{(&parser.VectorSelector{LabelMatchers: matchers}).String()}, nil
+	}
+	enforced := make([]string, 0, len(selectors))
+	for _, s := range selectors {
+		parsed, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, badRequest("invalid match[] selector: %v", err)
+		}
+		parsed, err = enforceMatchers(parsed, matchers)
+		if err != nil {
+			return nil, err
+		}
+		enforced = append(enforced, (&parser.VectorSelector{LabelMatchers: parsed}).String())
+	}
+	return enforced, nil
+}
+
+// enforceMatchers appends the tenant's matchers to those of a selector. A
+// selector may repeat a tenant's matcher or pick a single value the tenant may
+// see; any other matcher on a tenant's label is refused rather than silently
+// returning nothing.
+func enforceMatchers(selector, matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	for _, s := range selector {
+		if containsMatcher(matchers, s) {
+			continue
+		}
+		for _, m := range matchers {
+			switch {
+			case s.Name != m.Name:
+			case s.Type != labels.MatchEqual:
+				return nil, forbidden("selector %s overrides the permitted %s", s, m)
+			case !m.Matches(s.Value):
+				return nil, forbidden("selector %s is outside the permitted %s", s, m)
+			}
+		}
+	}
+
+	result := append([]*labels.Matcher(nil), selector...)
+	for _, m := range matchers {
+		if !containsMatcher(selector, m) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// containsMatcher reports whether list holds a matcher equal to m
+func containsMatcher(list []*labels.Matcher, m *labels.Matcher) bool {
+	for _, l := range list {
+		if l.Name == m.Name && l.Type == m.Type && l.Value == m.Value {
+			return true
+		}
+	}
+	return false
+}
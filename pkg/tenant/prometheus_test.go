@@ -0,0 +1,99 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+func TestPrometheusEnforceQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   string
+		status int
+	}{
+		{name: "bare metric", query: `up`, want: `up{namespace="team-a"}`},
+		{name: "range vector", query: `rate(http_requests_total{job="api"}[5m])`, want: `rate(http_requests_total{job="api",namespace="team-a"}[5m])`},
+		{name: "subquery", query: `max_over_time(rate(x[1m])[10m:1m])`, want: `max_over_time(rate(x{namespace="team-a"}[1m])[10m:1m])`},
+		{name: "offset", query: `x offset 5m`, want: `x{namespace="team-a"} offset 5m`},
+		{name: "at modifier", query: `x @ 1700000000`, want: `x{namespace="team-a"} @ 1700000000.000`},
+		{name: "at and offset in a range", query: `rate(x[5m] @ end() offset 1h)`, want: `rate(x{namespace="team-a"}[5m] @ end() offset 1h)`},
+		{name: "binary expression", query: `a / on(job) group_left b + 1`, want: `a{namespace="team-a"} / on (job) group_left () b{namespace="team-a"} + 1`},
+		{name: "tenant matcher repeated", query: `up{namespace="team-a"}`, want: `up{namespace="team-a"}`},
+		{name: "other namespace", query: `up{namespace="kube-system"}`, status: http.StatusForbidden},
+		{name: "other namespace in one operand", query: `a + b{namespace="kube-system"}`, status: http.StatusForbidden},
+		{name: "regular expression override", query: `up{namespace=~".+"}`, status: http.StatusForbidden},
+		{name: "negative override", query: `up{namespace!="team-a"}`, status: http.StatusForbidden},
+		{name: "unparsable", query: `sum(`, status: http.StatusBadRequest},
+	}
+
+	p := NewPrometheus([]config.Tenant{teamA})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := p.Enforce(authenticated(t, "/api/v1/query"), "/api/v1/query", url.Values{"query": {tt.query}})
+			checkRefusal(t, err, tt.status)
+			if tt.status == 0 && params.Get("query") != tt.want {
+				t.Errorf("query %s, want %s", params.Get("query"), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusEnforceMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		match  []string
+		want   []string
+		status int
+	}{
+		{name: "series", path: "/api/v1/series", match: []string{`up`, `{job="api"}`}, want: []string{`{__name__="up",namespace="team-a"}`, `{job="api",namespace="team-a"}`}},
+		{name: "labels without selector", path: "/api/v1/labels", want: []string{`{namespace="team-a"}`}},
+		{name: "label values", path: "/api/v1/label/job/values", match: []string{`up`}, want: []string{`{__name__="up",namespace="team-a"}`}},
+		{name: "federate", path: "/federate", match: []string{`{__name__=~"job:.*"}`}, want: []string{`{__name__=~"job:.*",namespace="team-a"}`}},
+		{name: "conflicting tenant matcher", path: "/federate", match: []string{`{namespace="team-b"}`}, status: http.StatusForbidden},
+		{name: "conflict in a later selector", path: "/api/v1/series", match: []string{`up`, `up{namespace!="team-a"}`}, status: http.StatusForbidden},
+		{name: "invalid selector", path: "/api/v1/series", match: []string{`up{`}, status: http.StatusBadRequest},
+		{name: "endpoint without data restriction", path: "/api/v1/targets", status: http.StatusForbidden},
+	}
+
+	p := NewPrometheus([]config.Tenant{teamA})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{}
+			if tt.match != nil {
+				params["match[]"] = tt.match
+			}
+			enforced, err := p.Enforce(authenticated(t, tt.path), tt.path, params)
+			checkRefusal(t, err, tt.status)
+			if tt.status == 0 && !reflect.DeepEqual(enforced["match[]"], tt.want) {
+				t.Errorf("match[] %q, want %q", enforced["match[]"], tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusEnforceClients(t *testing.T) {
+	r := authenticated(t, "/api/v1/query")
+	params := url.Values{"query": {`up`}}
+
+	unrestricted := NewPrometheus([]config.Tenant{{Name: "platform", Clients: []string{"*"}}})
+	enforced, err := unrestricted.Enforce(r, "/api/v1/query", params)
+	checkRefusal(t, err, 0)
+	if enforced.Get("query") != `up` {
+		t.Errorf("unrestricted tenant query rewritten to %s", enforced.Get("query"))
+	}
+
+	// The htpasswd user token-1 is a different client than the token named token-1
+	other := NewPrometheus([]config.Tenant{{Name: "team-b", Clients: []string{"basic:token-1"}, Matchers: []string{`namespace="team-b"`}}})
+	_, err = other.Enforce(r, "/api/v1/query", params)
+	checkRefusal(t, err, http.StatusForbidden)
+
+	_, err = other.Enforce(httptest.NewRequest(http.MethodGet, "/api/v1/query", nil), "/api/v1/query", params)
+	checkRefusal(t, err, http.StatusForbidden)
+}
@@ -0,0 +1,104 @@
+package tenant
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/auth"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/logging"
+)
+
+var logger = logging.SetupLogging()
+
+// Error is a request refused by tenant restrictions
+type Error struct {
+	Status  int
+	Message string
+}
+
+// Error returns the message sent to the client
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// forbidden returns a 403 Forbidden error
+func forbidden(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// badRequest returns a 400 Bad Request error
+func badRequest(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// tenant is a config.Tenant with its matchers parsed
+type tenant struct {
+	name     string
+	clients  []string
+	matchers []*labels.Matcher
+	// invalid tenants refuse every request; configuration validation keeps them out
+	invalid bool
+}
+
+// compile parses the matchers of every tenant
+func compile(tenants []config.Tenant) []tenant {
+	compiled := make([]tenant, 0, len(tenants))
+	for _, t := range tenants {
+		matchers, err := t.LabelMatchers()
+		if err != nil {
+			logger.Printf("Tenant %s refuses every request: %v", t.Name, err)
+		}
+		compiled = append(compiled, tenant{name: t.Name, clients: t.Clients, matchers: matchers, invalid: err != nil})
+	}
+	return compiled
+}
+
+// lookup returns the first tenant listing the authenticated client of r
+func lookup(tenants []tenant, r *http.Request) (tenant, error) {
+	id, ok := auth.IdentityFrom(r.Context())
+	if !ok {
+		return tenant{}, forbidden("tenant restrictions require an authenticated client")
+	}
+	for _, t := range tenants {
+		for _, client := range t.clients {
+			if client == "*" || client == id.String() {
+				if t.invalid {
+					return tenant{}, forbidden("tenant %s is misconfigured", t.name)
+				}
+				return t, nil
+			}
+		}
+	}
+	return tenant{}, forbidden("client %s does not belong to any tenant", id)
+}
+
+// requestParams returns the query string and form parameters of a GET or POST request
+func requestParams(r *http.Request) (url.Values, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, badRequest("invalid request parameters: %v", err)
+	}
+	return r.Form, nil
+}
+
+// setRequestParams replaces the parameters of r: a form POST carries them in
+// its body, any other request in the query string
+func setRequestParams(r *http.Request, params url.Values) {
+	encoded := params.Encode()
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.URL.RawQuery = ""
+		r.Body = http.NoBody
+		if encoded != "" {
+			r.Body = io.NopCloser(strings.NewReader(encoded))
+		}
+		r.ContentLength = int64(len(encoded))
+		r.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+		return
+	}
+	r.URL.RawQuery = encoded
+}
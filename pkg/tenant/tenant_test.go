@@ -0,0 +1,54 @@
+package tenant
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/auth"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+)
+
+// teamA limits its client to the team-a namespace
+var teamA = config.Tenant{Name: "team-a", Clients: []string{"token:token-1"}, Matchers: []string{`namespace="team-a"`}}
+
+// authenticated returns a GET request for target authenticated as the client
+// of the first inbound token, token:token-1
+func authenticated(t *testing.T, target string) *http.Request {
+	t.Helper()
+	chain, err := auth.New(config.Config{InboundAuthTokens: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	var accepted *http.Request
+	chain.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if accepted == nil {
+		t.Fatal("test client was not authenticated")
+	}
+	return accepted
+}
+
+// checkRefusal fails the test unless err is an *Error with the given status,
+// or nil when status is 0
+func checkRefusal(t *testing.T, err error, status int) {
+	t.Helper()
+	if status == 0 {
+		if err != nil {
+			t.Fatalf("refused: %v", err)
+		}
+		return
+	}
+	var refusal *Error
+	if !errors.As(err, &refusal) {
+		t.Fatalf("error %v, want a *tenant.Error with status %d", err, status)
+	}
+	if refusal.Status != status {
+		t.Fatalf("status %d (%v), want %d", refusal.Status, refusal, status)
+	}
+}
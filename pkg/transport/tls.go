@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/credentials"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// rancherTLS is the TLS configuration applied to every connection to Rancher
+var rancherTLS *tls.Config
+
+// LoadTLSConfig builds the TLS configuration for Rancher connections from cfg.
+// It must be called before the first transport is created; transports created
+// without it only honour RANCHER_INSECURE_SKIP_VERIFY.
+func LoadTLSConfig(cfg config.Config) error {
+	tlsConfig, err := BuildTLSConfig(cfg, credentials.Current())
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	rancherTLS = tlsConfig
+	mu.Unlock()
+	return nil
+}
+
+// BuildTLSConfig returns a TLS configuration with the CA bundle, client
+// certificate, minimum version and server name configured in cfg, plus any
+// CA or client certificate supplied by the credential source
+func BuildTLSConfig(cfg config.Config, source *credentials.Source) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.RancherInsecureSkipVerify,
+		ServerName:         cfg.RancherTLSServerName,
+	}
+
+	minVersion, ok := tlsVersions[cfg.RancherTLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported RANCHER_TLS_MIN_VERSION %q, expected one of 1.0, 1.1, 1.2, 1.3", cfg.RancherTLSMinVersion)
+	}
+	tlsConfig.MinVersion = minVersion
+
+	if cfg.RancherCAFile != "" || cfg.RancherCAPEM != "" || len(source.CAData) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if cfg.RancherCAFile != "" {
+			pem, err := os.ReadFile(cfg.RancherCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading RANCHER_CA_FILE: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in RANCHER_CA_FILE %s", cfg.RancherCAFile)
+			}
+		}
+		if cfg.RancherCAPEM != "" && !pool.AppendCertsFromPEM([]byte(cfg.RancherCAPEM)) {
+			return nil, fmt.Errorf("no certificates found in RANCHER_CA_PEM")
+		}
+		if len(source.CAData) > 0 && !pool.AppendCertsFromPEM(source.CAData) {
+			return nil, fmt.Errorf("no certificates found in %s certificate authority", source.Type)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.RancherClientCertFile != "" || cfg.RancherClientKeyFile != "" {
+		if cfg.RancherClientCertFile == "" || cfg.RancherClientKeyFile == "" {
+			return nil, fmt.Errorf("RANCHER_CLIENT_CERT_FILE and RANCHER_CLIENT_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.RancherClientCertFile, cfg.RancherClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading Rancher client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if source.ClientCertificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*source.ClientCertificate}
+	}
+
+	return tlsConfig, nil
+}
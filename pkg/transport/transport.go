@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/config"
+	"github.com/supporttools/rancher-centralized-monitoring/pkg/credentials"
+)
+
+// Upstream name used for calls to the Rancher API itself rather than a relayed service
+const RancherUpstream = "rancher"
+
+var (
+	mu         sync.Mutex
+	transports = make(map[string]*instrumentedTransport)
+)
+
+// For returns the shared round tripper for the named upstream, creating it on
+// first use. All requests to the same upstream share one connection pool, so
+// TLS handshakes with Rancher are only paid when a new connection is needed.
+func For(upstream string) http.RoundTripper {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t, ok := transports[upstream]
+	if !ok {
+		t = newInstrumentedTransport()
+		transports[upstream] = t
+	}
+	return t
+}
+
+// NewClient returns an HTTP client with the given timeout that uses the shared transport for upstream
+func NewClient(upstream string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: For(upstream),
+	}
+}
+
+// ConnectionStats tracks connection pool activity of one upstream transport
+type ConnectionStats struct {
+	Open          atomic.Int64
+	Dialed        atomic.Uint64
+	Reused        atomic.Uint64
+	TLSHandshakes atomic.Uint64
+}
+
+// Stats returns the connection pool stats of every upstream transport created so far
+func Stats() map[string]*ConnectionStats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	stats := make(map[string]*ConnectionStats, len(transports))
+	for upstream, t := range transports {
+		stats[upstream] = t.stats
+	}
+	return stats
+}
+
+// Reload rebuilds the TLS configuration from cfg and the current credentials and
+// moves every upstream onto a new connection pool that uses it. Requests in
+// flight finish on their existing connections; idle ones are closed.
+func Reload(cfg config.Config) error {
+	if err := LoadTLSConfig(cfg); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, t := range transports {
+		old := t.transport.Swap(newHTTPTransport(t.stats))
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// instrumentedTransport wraps an http.Transport and records connection pool stats
+type instrumentedTransport struct {
+	transport atomic.Pointer[http.Transport]
+	stats     *ConnectionStats
+}
+
+// newInstrumentedTransport builds a transport from the upstream settings in config.Current
+func newInstrumentedTransport() *instrumentedTransport {
+	t := &instrumentedTransport{stats: &ConnectionStats{}}
+	t.transport.Store(newHTTPTransport(t.stats))
+	return t
+}
+
+// newHTTPTransport builds a pooled transport that records its connections in stats.
+// It must be called with mu held.
+func newHTTPTransport(stats *ConnectionStats) *http.Transport {
+	cfg := config.Current()
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.RancherInsecureSkipVerify}
+	if rancherTLS != nil {
+		tlsConfig = rancherTLS.Clone()
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.UpstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// HTTP/2 is only negotiated when ForceAttemptHTTP2 is set because DialContext
+	// and TLSClientConfig are customized
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			stats.Dialed.Add(1)
+			stats.Open.Add(1)
+			return &countedConn{Conn: conn, stats: stats}, nil
+		},
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   cfg.UpstreamHTTP2,
+		MaxIdleConns:        cfg.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost: cfg.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:     cfg.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:     cfg.UpstreamIdleConnTimeout,
+		TLSHandshakeTimeout: cfg.UpstreamTLSHandshakeTimeout,
+	}
+}
+
+// RoundTrip authenticates the request with the current credentials and sends it on
+// the pooled transport, tracing connection reuse and TLS handshakes. A 401 makes
+// the credential files get re-read, and the request is retried once with the new
+// credentials if they changed and the body can be replayed.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	source := credentials.Current()
+	resp, err := t.roundTrip(req, source)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if !credentials.ReloadOnUnauthorized(source) || !replayable(req) {
+		return resp, nil
+	}
+
+	retry := req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return t.roundTrip(retry, credentials.Current())
+}
+
+// replayable reports whether req can be sent a second time
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// roundTrip sends req authenticated with source
+func (t *instrumentedTransport) roundTrip(req *http.Request, source *credentials.Source) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.stats.Reused.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.stats.TLSHandshakes.Add(1)
+			}
+		},
+	}
+	outReq := req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	source.Credentials.Apply(outReq)
+	return t.transport.Load().RoundTrip(outReq)
+}
+
+// countedConn decrements the open connection gauge when the connection is closed
+type countedConn struct {
+	net.Conn
+	stats     *ConnectionStats
+	closeOnce sync.Once
+}
+
+// Close closes the underlying connection and records it as no longer open
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() { c.stats.Open.Add(-1) })
+	return c.Conn.Close()
+}